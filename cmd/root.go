@@ -1,17 +1,26 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/romanzac/gorilla-feast/controller/dbhandler"
 	"github.com/romanzac/gorilla-feast/controller/httphandler"
+	"github.com/romanzac/gorilla-feast/infra/cluster"
 	"github.com/romanzac/gorilla-feast/infra/config"
 	"github.com/romanzac/gorilla-feast/infra/database"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"github.com/romanzac/gorilla-feast/infra/hub"
+	"github.com/romanzac/gorilla-feast/infra/idempotency"
+	"github.com/romanzac/gorilla-feast/infra/outbox"
 	"github.com/romanzac/gorilla-feast/infra/router"
+	"github.com/romanzac/gorilla-feast/infra/validation"
+	"github.com/romanzac/gorilla-feast/infra/webhook"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -52,6 +61,32 @@ func initConfig(cmd *cobra.Command, args []string) {
 	viper.SetEnvPrefix("GORILLA_FEAST")
 	viper.AutomaticEnv()
 
+	// Defaults for optional values
+	viper.SetDefault("MaxBodySize", 1<<20)
+	viper.SetDefault("PageSize", 50)
+	viper.SetDefault("MaxPageSize", 500)
+	viper.SetDefault("SortCollation", "und-x-icu")
+	viper.SetDefault("SearchThreshold", 0.3)
+	viper.SetDefault("AcctPattern", validation.DefaultAcctPattern)
+	viper.SetDefault("FullnamePattern", validation.DefaultFullnamePattern)
+	viper.SetDefault("ReservedAccts", "admin,administrator,root,system,support,api,null,anonymous")
+	viper.SetDefault("WSBufferSize", 16)
+	viper.SetDefault("WSSlowConsumerPolicy", "drop")
+	viper.SetDefault("WSAllowedRoles", "admin")
+	viper.SetDefault("LockoutWindow", "15m")
+	viper.SetDefault("LockoutDuration", "15m")
+	viper.SetDefault("EventHistorySize", 1000)
+	viper.SetDefault("ClusterChannel", "gorilla_feast_events")
+	viper.SetDefault("IdempotencyWindow", "24h")
+	viper.SetDefault("IdempotencyLease", "1m")
+	viper.SetDefault("OutboxInterval", "1s")
+	viper.SetDefault("OutboxBatchSize", 100)
+	viper.SetDefault("SSEHeartbeat", "15s")
+	viper.SetDefault("WebhookWorkers", 4)
+	viper.SetDefault("WebhookMaxAttempts", 5)
+	viper.SetDefault("WebhookBackoff", "1s")
+	viper.SetDefault("WebhookTimeout", "10s")
+
 	// Read the environment and configuration file
 	err := viper.ReadInConfig()
 
@@ -65,10 +100,147 @@ func initConfig(cmd *cobra.Command, args []string) {
 		config.Cfg.Web.JWTPrivKey = viper.Get("JWTPrivKey").(string)
 		config.Cfg.Web.JWTPubKey = viper.Get("JWTPubKey").(string)
 		config.Cfg.Database.PostgresURI = viper.Get("PostgresURI").(string)
+
+		// Optional values
+		config.Cfg.Web.MaxBodySize = viper.GetInt64("MaxBodySize")
+		config.Cfg.Web.ConcealSignupConflict = enabled("ConcealSignupConflict")
+		config.Cfg.Web.PageSize = viper.GetInt("PageSize")
+		config.Cfg.Web.MaxPageSize = viper.GetInt("MaxPageSize")
+		config.Cfg.Web.SortCollation = viper.GetString("SortCollation")
+		config.Cfg.Web.SearchThreshold = viper.GetFloat64("SearchThreshold")
+		config.Cfg.Web.AcctPattern = viper.GetString("AcctPattern")
+		config.Cfg.Web.FullnamePattern = viper.GetString("FullnamePattern")
+		config.Cfg.Web.ReservedAccts = list("ReservedAccts")
+		config.Cfg.Web.ValidateRequests = enabled("ValidateRequests")
+		config.Cfg.Web.WSBufferSize = viper.GetInt("WSBufferSize")
+		config.Cfg.Web.WSSlowConsumerPolicy = viper.GetString("WSSlowConsumerPolicy")
+		config.Cfg.Web.WSAllowedRoles = list("WSAllowedRoles")
+		config.Cfg.Web.WSAllowedOrigins = list("WSAllowedOrigins")
+		readWSKeepalive()
+		config.Cfg.Web.LockoutThreshold = viper.GetInt("LockoutThreshold")
+		config.Cfg.Web.LockoutWindow = viper.GetDuration("LockoutWindow")
+		config.Cfg.Web.LockoutDuration = viper.GetDuration("LockoutDuration")
+		config.Cfg.Web.EventHistorySize = viper.GetInt("EventHistorySize")
+		config.Cfg.Web.PersistEvents = enabled("PersistEvents")
+		config.Cfg.Web.ClusterEvents = enabled("ClusterEvents")
+		config.Cfg.Web.ClusterChannel = viper.GetString("ClusterChannel")
+		config.Cfg.Web.IdempotencyWindow = viper.GetDuration("IdempotencyWindow")
+		config.Cfg.Web.IdempotencyLease = viper.GetDuration("IdempotencyLease")
+		config.Cfg.Web.OutboxInterval = viper.GetDuration("OutboxInterval")
+		config.Cfg.Web.OutboxBatchSize = viper.GetInt("OutboxBatchSize")
+		config.Cfg.Web.SSEHeartbeat = viper.GetDuration("SSEHeartbeat")
+		config.Cfg.Web.WebhookWorkers = viper.GetInt("WebhookWorkers")
+		config.Cfg.Web.WebhookMaxAttempts = viper.GetInt("WebhookMaxAttempts")
+		config.Cfg.Web.WebhookBackoff = viper.GetDuration("WebhookBackoff")
+		config.Cfg.Web.WebhookTimeout = viper.GetDuration("WebhookTimeout")
 	} else {
 		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
 		os.Exit(1)
 	}
+
+	if _, err = hub.ParsePolicy(config.Cfg.Web.WSSlowConsumerPolicy); err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+	if err = validateWSKeepalive(); err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+	if config.Cfg.Web.MaxBodySize <= 0 {
+		fmt.Fprintf(os.Stdout, "err loading config: MaxBodySize must be positive number of bytes")
+		os.Exit(1)
+	}
+	if config.Cfg.Web.PageSize <= 0 || config.Cfg.Web.PageSize > config.Cfg.Web.MaxPageSize {
+		fmt.Fprintf(os.Stdout, "err loading config: PageSize must be positive and at most MaxPageSize")
+		os.Exit(1)
+	}
+	if !collationName.MatchString(config.Cfg.Web.SortCollation) {
+		fmt.Fprintf(os.Stdout, "err loading config: SortCollation is not valid collation name")
+		os.Exit(1)
+	}
+	if config.Cfg.Web.SearchThreshold <= 0 || config.Cfg.Web.SearchThreshold > 1 {
+		fmt.Fprintf(os.Stdout, "err loading config: SearchThreshold must be above 0 and at most 1")
+		os.Exit(1)
+	}
+	if err = validation.InitUsers(config.Cfg.Web.AcctPattern, config.Cfg.Web.FullnamePattern,
+		config.Cfg.Web.ReservedAccts); err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+	if config.Cfg.Web.IdempotencyWindow <= 0 {
+		fmt.Fprintf(os.Stdout, "err loading config: IdempotencyWindow must be positive duration")
+		os.Exit(1)
+	}
+	if lease := config.Cfg.Web.IdempotencyLease; lease <= 0 || lease > config.Cfg.Web.IdempotencyWindow {
+		fmt.Fprintf(os.Stdout, "err loading config: IdempotencyLease must be positive up to IdempotencyWindow")
+		os.Exit(1)
+	}
+	if config.Cfg.Web.ClusterEvents && !config.Cfg.Web.PersistEvents {
+		fmt.Fprintf(os.Stdout, "err loading config: ClusterEvents requires PersistEvents")
+		os.Exit(1)
+	}
+	if config.Cfg.Web.OutboxInterval <= 0 {
+		fmt.Fprintf(os.Stdout, "err loading config: OutboxInterval must be positive duration")
+		os.Exit(1)
+	}
+	if config.Cfg.Web.SSEHeartbeat <= 0 {
+		fmt.Fprintf(os.Stdout, "err loading config: SSEHeartbeat must be positive duration")
+		os.Exit(1)
+	}
+	if config.Cfg.Web.WebhookMaxAttempts < 1 {
+		fmt.Fprintf(os.Stdout, "err loading config: WebhookMaxAttempts must be at least 1")
+		os.Exit(1)
+	}
+	if config.Cfg.Web.WebhookBackoff <= 0 || config.Cfg.Web.WebhookTimeout <= 0 {
+		fmt.Fprintf(os.Stdout, "err loading config: WebhookBackoff and WebhookTimeout must be positive durations")
+		os.Exit(1)
+	}
+}
+
+// collationName matches names of collations which are safe to put into SQL
+var collationName = regexp.MustCompile(`^[A-Za-z0-9_.@-]*$`)
+
+// enabled reports whether an optional yes/no configuration value is switched on
+func enabled(key string) bool {
+	v := strings.ToLower(viper.GetString(key))
+	return v == "yes" || v == "true"
+}
+
+// readWSKeepalive reads optional websocket keepalive and compression values shared by server and client
+func readWSKeepalive() {
+	viper.SetDefault("WSPingInterval", "30s")
+	viper.SetDefault("WSPongWait", "60s")
+	viper.SetDefault("WSWriteWait", "10s")
+	viper.SetDefault("WSMaxMessageSize", 32768)
+	viper.SetDefault("WSCompression", "yes")
+
+	config.Cfg.Web.WSPingInterval = viper.GetDuration("WSPingInterval")
+	config.Cfg.Web.WSPongWait = viper.GetDuration("WSPongWait")
+	config.Cfg.Web.WSWriteWait = viper.GetDuration("WSWriteWait")
+	config.Cfg.Web.WSMaxMessageSize = viper.GetInt64("WSMaxMessageSize")
+	config.Cfg.Web.WSCompression = enabled("WSCompression")
+}
+
+// validateWSKeepalive checks pong is awaited longer than pings are sent
+func validateWSKeepalive() error {
+	if config.Cfg.Web.WSPingInterval <= 0 || config.Cfg.Web.WSWriteWait <= 0 {
+		return errors.New("WSPingInterval and WSWriteWait must be positive durations")
+	}
+	if config.Cfg.Web.WSPongWait <= config.Cfg.Web.WSPingInterval {
+		return errors.New("WSPongWait must be longer than WSPingInterval")
+	}
+	return nil
+}
+
+// list reads optional comma separated configuration value
+func list(key string) []string {
+	var values []string
+	for _, v := range strings.Split(viper.GetString(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
 }
 
 // startGorillaFeast starts Gorilla Feast API controller
@@ -77,14 +249,44 @@ func startGorillaFeast(cmd *cobra.Command, args []string) {
 	// Initialize DB
 	database.InitDB(config.Cfg.Database.PostgresURI)
 
-	// Initialize router and failure channel
+	// Initialize event bus, policy was validated with config
+	policy, _ := hub.ParsePolicy(config.Cfg.Web.WSSlowConsumerPolicy)
+	eventbus.InitEvents(config.Cfg.Web.WSBufferSize, policy, config.Cfg.Web.EventHistorySize)
+	if config.Cfg.Web.PersistEvents {
+		if err := eventbus.Events.Persist(dbhandler.NewDbEventRepo()); err != nil {
+			log.Fatal("Error loading last event ID: ", err)
+		}
+	}
+	if config.Cfg.Web.ClusterEvents {
+		if err := cluster.InitNotifier(database.DB, config.Cfg.Database.PostgresURI,
+			config.Cfg.Web.ClusterChannel, eventbus.Events); err != nil {
+			log.Fatal("Error listening to cluster events: ", err)
+		}
+	}
+
+	// Initialize router
 	r := router.NewRouter()
 
 	// Initialize repositories
+	webhookDBRepo := dbhandler.NewDbWebhookRepo()
+
+	// Initialize webhook deliveries of all events
+	webhook.InitDeliveries(webhookDBRepo, config.Cfg.Web.WebhookWorkers, config.Cfg.Web.WebhookMaxAttempts,
+		config.Cfg.Web.WebhookBackoff, config.Cfg.Web.WebhookTimeout)
+
+	// Initialize relay of user events committed to the outbox to subscribers and webhooks
+	outbox.InitPublisher(dbhandler.NewDbOutboxRepo(), eventbus.Events, webhook.Deliveries,
+		config.Cfg.Web.OutboxInterval, config.Cfg.Web.OutboxBatchSize)
+
+	// User repository notifies the relay of committed events
 	userDBRepo := dbhandler.NewDbUserRepo()
 
+	// Initialize responses replayed for retried POST requests
+	idempotency.InitKeys(dbhandler.NewDbIdempotencyRepo(), config.Cfg.Web.IdempotencyWindow,
+		config.Cfg.Web.IdempotencyLease, config.Cfg.Web.MaxBodySize)
+
 	// Initialize APIs
-	apiv1 := httphandler.NewAPIv1(userDBRepo)
+	apiv1 := httphandler.NewAPIv1(userDBRepo, webhookDBRepo)
 
 	// Add routes
 	httphandler.InitRoutes(r, apiv1)
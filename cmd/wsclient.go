@@ -1,15 +1,33 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/alert"
 	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"github.com/romanzac/gorilla-feast/infra/eventcodec"
+	"github.com/romanzac/gorilla-feast/infra/eventsink"
+	"github.com/romanzac/gorilla-feast/middleware"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"log"
+	"math/rand"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
@@ -17,7 +35,7 @@ var (
 	startWSClientCmd = &cobra.Command{
 		Use:              "wsclient",
 		Short:            "Start websocket client process",
-		Long:             `Start websocket client process which receives messages about failed logins`,
+		Long:             `Start websocket client process which receives events about failed logins or other chosen events`,
 		Version:          "1.0.0",
 		PersistentPreRun: initWSConfig,
 		Run:              startWSClient,
@@ -26,6 +44,43 @@ var (
 
 func init() {
 	GorillaFeastCmd.AddCommand(startWSClientCmd)
+
+	flags := startWSClientCmd.Flags()
+	flags.String("token", "", "JWT token of a user allowed to subscribe")
+	flags.String("login-acct", "", "acct of a user allowed to subscribe to log in with before every connection")
+	flags.String("state-file", "wsclient.state", "file to remember the last received event ID")
+	flags.Int("max-retries", 0, "failed attempts to reconnect before giving up, 0 retries forever")
+	flags.String("format", eventsink.FormatText, "output format: text, json, ndjson or logfmt")
+	flags.String("acct", "", "receive only events of accts matching glob pattern")
+	flags.String("type", model.TopicLoginFailed, "comma separated event types to receive, user.* matches all user events")
+	flags.String("sink", "stdout", "comma separated outputs: stdout, file and syslog")
+	flags.String("file", "wsclient.log", "file for file output")
+	flags.Int64("file-max-size", 10, "size in MB at which file output is rotated")
+	flags.Int("file-max-backups", 5, "rotated files to keep")
+	flags.String("syslog-tag", "gorilla-feast-wsclient", "tag of syslog output")
+	flags.Int("count", 0, "exit after receiving this many events, 0 runs forever")
+	flags.Duration("timeout", 0, "exit after this time, with non-zero code if --count was not reached")
+	flags.String("encoding", "json", "encoding of events on the websocket: json, msgpack or protobuf")
+
+	for key, flag := range map[string]string{
+		"WSToken":          "token",
+		"WSLoginAcct":      "login-acct",
+		"WSStateFile":      "state-file",
+		"WSMaxRetries":     "max-retries",
+		"WSFormat":         "format",
+		"WSAcct":           "acct",
+		"WSType":           "type",
+		"WSSink":           "sink",
+		"WSFile":           "file",
+		"WSFileMaxSize":    "file-max-size",
+		"WSFileMaxBackups": "file-max-backups",
+		"WSSyslogTag":      "syslog-tag",
+		"WSCount":          "count",
+		"WSTimeout":        "timeout",
+		"WSEncoding":       "encoding",
+	} {
+		_ = viper.BindPFlag(key, flags.Lookup(flag))
+	}
 }
 
 // initWSConfig loads config values for WSClient
@@ -54,54 +109,430 @@ func initWSConfig(cmd *cobra.Command, args []string) {
 		}
 		config.Cfg.Web.Port = viper.Get("Port").(string)
 		config.Cfg.Web.DisableTLS = strings.ToLower(viper.Get("DisableTLS").(string))
+		config.Cfg.WSClient.Token = viper.GetString("WSToken")
+		config.Cfg.WSClient.LoginAcct = viper.GetString("WSLoginAcct")
+		config.Cfg.WSClient.LoginPwd = viper.GetString("WSLoginPwd")
+		config.Cfg.WSClient.StateFile = viper.GetString("WSStateFile")
+		config.Cfg.WSClient.MaxRetries = viper.GetInt("WSMaxRetries")
+		viper.SetDefault("WSReconnectMin", "1s")
+		viper.SetDefault("WSReconnectMax", "1m")
+		config.Cfg.WSClient.ReconnectMin = viper.GetDuration("WSReconnectMin")
+		config.Cfg.WSClient.ReconnectMax = viper.GetDuration("WSReconnectMax")
+		config.Cfg.WSClient.Format = strings.ToLower(viper.GetString("WSFormat"))
+		config.Cfg.WSClient.Acct = viper.GetString("WSAcct")
+		config.Cfg.WSClient.Types = viper.GetString("WSType")
+		config.Cfg.WSClient.Sinks = list("WSSink")
+		config.Cfg.WSClient.File = viper.GetString("WSFile")
+		config.Cfg.WSClient.FileMaxSize = viper.GetInt64("WSFileMaxSize") << 20
+		config.Cfg.WSClient.FileMaxBackups = viper.GetInt("WSFileMaxBackups")
+		config.Cfg.WSClient.SyslogTag = viper.GetString("WSSyslogTag")
+		config.Cfg.WSClient.Count = viper.GetInt("WSCount")
+		config.Cfg.WSClient.Timeout = viper.GetDuration("WSTimeout")
+		config.Cfg.WSClient.Encoding = strings.ToLower(viper.GetString("WSEncoding"))
+		viper.SetDefault("WSAlertTimeout", "10s")
+		config.Cfg.WSClient.AlertTimeout = viper.GetDuration("WSAlertTimeout")
+		if err = viper.UnmarshalKey("WSAlerts", &config.Cfg.WSClient.Alerts); err != nil {
+			fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+			os.Exit(1)
+		}
+		readWSKeepalive()
 	} else {
 		os.Exit(1)
 	}
+
+	if err := validateWSKeepalive(); err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+	if (config.Cfg.WSClient.LoginAcct == "") != (config.Cfg.WSClient.LoginPwd == "") {
+		fmt.Fprintf(os.Stdout, "err loading config: WSLoginAcct and WSLoginPwd must be set together")
+		os.Exit(1)
+	}
+	if _, err := eventsink.Format(model.Event{}, config.Cfg.WSClient.Format); err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+	if err := eventsink.CheckNames(config.Cfg.WSClient.Sinks); err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+	if _, err := eventbus.ParseFilter(config.Cfg.WSClient.Types, config.Cfg.WSClient.Acct); err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+	encoding, err := eventcodec.Parse(config.Cfg.WSClient.Encoding)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+	config.Cfg.WSClient.Encoding = encoding
+	if _, err := alert.NewEngine(config.Cfg.WSClient.Alerts); err != nil {
+		fmt.Fprintf(os.Stdout, "err loading config: %s", err)
+		os.Exit(1)
+	}
+}
+
+// jitter randomizes reconnect delays, so clients do not reconnect all at once
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// errWSRejected occurs when the server refuses the handshake, connecting again would not help
+var errWSRejected = errors.New("subscription rejected by the server")
+
+// wsSession keeps state of the websocket client across reconnects
+type wsSession struct {
+	lastID   uint64
+	received int
+	filter   eventbus.Filter
+	sinks    eventsink.Multi
+	alerts   *alert.Engine
+	stop     chan struct{}
+	stopOnce sync.Once
+	exitCode int
 }
 
-// startWSClient starts websocket client to listen to failed sign ins
+// startWSClient starts websocket client to listen to failed sign ins, it reconnects
+// with jittered exponential back-off and exits with non-zero code when it gives up
 func startWSClient(cmd *cobra.Command, args []string) {
+	cfg := config.Cfg.WSClient
+
+	sinks, err := eventsink.Open(cfg.Sinks, cfg.File, cfg.FileMaxSize, cfg.FileMaxBackups, cfg.SyslogTag)
+	if err != nil {
+		log.Fatal("Error opening output: ", err)
+	}
+
+	// Resume after the last event received before, filter was validated with config
+	s := &wsSession{sinks: sinks, stop: make(chan struct{})}
+	s.lastID = readLastEventID(cfg.StateFile)
+	s.filter, _ = eventbus.ParseFilter(cfg.Types, cfg.Acct)
+	s.alerts, _ = alert.NewEngine(cfg.Alerts)
+
+	// Stop on interrupt or when the time is up
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		s.finish(0, "Stopping on interrupt")
+	}()
+	if cfg.Timeout > 0 {
+		time.AfterFunc(cfg.Timeout, func() {
+			if cfg.Count > 0 {
+				s.finish(1, fmt.Sprintf("Timed out before receiving %d events", cfg.Count))
+			} else {
+				s.finish(0, "Stopping on timeout")
+			}
+		})
+	}
 
-	// Prepare URL for the client
-	var u url.URL
-	if config.Cfg.Web.DisableTLS == "yes" || config.Cfg.Web.DisableTLS == "true" {
-		u = url.URL{Scheme: "ws", Host: config.Cfg.Web.Listen + ":" + config.Cfg.Web.Port, Path: "/login-failures"}
-	} else {
-		u = url.URL{Scheme: "wss", Host: config.Cfg.Web.Listen + ":" + config.Cfg.Web.Port, Path: "/login-failures"}
+	attempt := 0
+	for {
+		connected, err := s.connect()
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errWSRejected) {
+			s.finish(1, "Giving up: "+err.Error())
+			break
+		}
+
+		// Connection which was up starts counting retries again
+		if connected {
+			attempt = 0
+		}
+		attempt++
+		if cfg.MaxRetries > 0 && attempt > cfg.MaxRetries {
+			s.finish(1, fmt.Sprintf("Giving up after %d failed attempts to reconnect", cfg.MaxRetries))
+			break
+		}
+
+		wait := reconnectDelay(attempt)
+		log.Printf("Disconnected, reconnecting in %s (attempt %d)", wait.Round(time.Millisecond), attempt)
+		select {
+		case <-time.After(wait):
+			continue
+		case <-s.stop:
+		}
+		break
 	}
 
-	log.Printf("Connected to %s", u.String())
+	if err = s.sinks.Close(); err != nil {
+		log.Println("Error closing output: ", err)
+	}
+	if s.exitCode != 0 {
+		os.Exit(s.exitCode)
+	}
+}
+
+// finish stops the client with exit code, only the first call counts
+func (s *wsSession) finish(code int, reason string) {
+	s.stopOnce.Do(func() {
+		log.Println(reason)
+		s.exitCode = code
+		close(s.stop)
+	})
+}
+
+// reconnectDelay doubles the back-off with every attempt up to the maximum,
+// random half of it spreads reconnects of many clients
+func reconnectDelay(attempt int) time.Duration {
+	d := config.Cfg.WSClient.ReconnectMax
+	if attempt < 32 && config.Cfg.WSClient.ReconnectMin<<(attempt-1) < d {
+		d = config.Cfg.WSClient.ReconnectMin << (attempt - 1)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1))
+}
+
+// wsURL prepares URL for the client to receive chosen events after event lastID
+func wsURL(lastID uint64) url.URL {
+	u := serverURL("ws", "/events")
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	// Server filters events too, so they do not travel in vain
+	query := url.Values{}
+	query.Set("topic", config.Cfg.WSClient.Types)
+	if config.Cfg.WSClient.Acct != "" {
+		query.Set("acct", config.Cfg.WSClient.Acct)
+	}
+	if lastID > 0 {
+		query.Set("since", strconv.FormatUint(lastID, 10))
+	}
+	u.RawQuery = query.Encode()
+
+	return u
+}
+
+// rejected tells whether handshake answered with status would fail again, which are client errors
+// other than timeouts and rate limits
+func rejected(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 400 && status < 500
+}
+
+// serverURL returns URL of path on the server, scheme is "http" or "ws" and gets TLS unless it is disabled
+func serverURL(scheme, path string) url.URL {
+	if config.Cfg.Web.DisableTLS != "yes" && config.Cfg.Web.DisableTLS != "true" {
+		scheme += "s"
+	}
+	return url.URL{Scheme: scheme, Host: config.Cfg.Web.Listen + ":" + config.Cfg.Web.Port, Path: path}
+}
+
+// wsToken returns token to subscribe with. Service acct logs in for fresh token before every connection,
+// as tokens expire after one hour, otherwise the configured token is used.
+func wsToken() (string, error) {
+	cfg := config.Cfg.WSClient
+	if cfg.LoginAcct == "" {
+		return cfg.Token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"acct": cfg.LoginAcct, "pwd": cfg.LoginPwd})
+	if err != nil {
+		return "", err
+	}
+	u := serverURL("http", "/api/v1/login")
+	client := &http.Client{Timeout: config.Cfg.Web.WSWriteWait}
+	resp, err := client.Post(u.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("Error logging in: ", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if rejected(resp.StatusCode) {
+		return "", fmt.Errorf("%w: login of %s answered %s", errWSRejected, cfg.LoginAcct, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Println("Error logging in: ", resp.Status)
+		return "", fmt.Errorf("login answered %s", resp.Status)
+	}
+	var token middleware.JWTToken
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		log.Println("Error reading login token: ", err)
+		return "", err
+	}
+	return token.Token, nil
+}
+
+// connect connects to the server and handles events until the connection is lost
+// or the client stops. It returns nil on stop and whether the connection was up.
+func (s *wsSession) connect() (bool, error) {
+	u := wsURL(atomic.LoadUint64(&s.lastID))
+
+	// Server accepts only subscribers with a valid token
+	token, err := wsToken()
 	if err != nil {
-		log.Fatal("Error connecting to the server: ", err)
+		return false, err
 	}
-	defer c.Close()
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	// Ask for the encoding and compression, the server may not support them
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{config.Cfg.WSClient.Encoding}
+	dialer.EnableCompression = config.Cfg.Web.WSCompression
+
+	log.Printf("Connecting to %s", u.String())
+	c, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil && rejected(resp.StatusCode) {
+			return false, fmt.Errorf("%w: %s", errWSRejected, resp.Status)
+		}
+		log.Println("Error connecting to the server: ", err)
+		return false, err
+	}
+	defer func(c *websocket.Conn) {
+		if err := c.Close(); err != nil {
+			log.Println("Error closing connection: ", err)
+		}
+	}(c)
+	log.Printf("Connected to %s", u.String())
+
+	// Server which did not confirm the encoding sends JSON
+	encoding := c.Subprotocol()
+	if encoding == "" {
+		encoding = eventcodec.JSON
+	}
+
+	// Any message, ping or pong from the server proves the connection is alive
+	cfg := config.Cfg.Web
+	c.SetReadLimit(cfg.WSMaxMessageSize)
+	_ = c.SetReadDeadline(time.Now().Add(cfg.WSPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(cfg.WSPongWait))
+	})
+	c.SetPingHandler(func(data string) error {
+		_ = c.SetReadDeadline(time.Now().Add(cfg.WSPongWait))
+		err := c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(cfg.WSWriteWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
 
 	// Wait for new messages
+	done := make(chan error, 1)
 	go func() {
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
-				log.Println("Error reading from the server: ", err)
+				if ce, ok := err.(*websocket.CloseError); ok {
+					log.Printf("Server closed connection: %d %s", ce.Code, ce.Text)
+				} else {
+					log.Println("Error reading from the server: ", err)
+				}
+				done <- err
 				return
 			}
-			log.Println(string(message))
+			_ = c.SetReadDeadline(time.Now().Add(cfg.WSPongWait))
+			s.handle(encoding, message)
 		}
 	}()
 
-	// Wait for the interrupt from keyboard and send close connection message to the server
-	for range interrupt {
-		log.Println("Closing connection on interrupt from keyboard")
-		err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		if err != nil {
-			log.Println("Error sending close message to the server: ", err)
-			return
-		} else {
-			c.Close()
-			return
+	ping := time.NewTicker(cfg.WSPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			return true, err
+		case <-ping.C:
+			err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.WSWriteWait))
+			if err != nil {
+				log.Println("Error sending ping to the server: ", err)
+				return true, err
+			}
+		case <-s.stop:
+			// Send close connection message to the server and wait for its answer
+			err := c.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(cfg.WSWriteWait))
+			if err != nil {
+				log.Println("Error sending close message to the server: ", err)
+				return true, nil
+			}
+			select {
+			case <-done:
+			case <-time.After(cfg.WSWriteWait):
+			}
+			return true, nil
+		}
+	}
+}
+
+// handle writes event to outputs when it passes the filter, remembers its ID, counts it
+// and fires alerts
+func (s *wsSession) handle(encoding string, message []byte) {
+	e, err := eventcodec.Unmarshal(encoding, message)
+	if err != nil {
+		log.Println("Error decoding event: ", err)
+		return
+	}
+
+	// Remember the event, so it is not received again after reconnect
+	if e.ID > 0 {
+		atomic.StoreUint64(&s.lastID, e.ID)
+		if err := saveLastEventID(config.Cfg.WSClient.StateFile, e.ID); err != nil {
+			log.Println("Error saving last event ID: ", err)
 		}
 	}
+
+	// Alert rules see every received event, hooks run in the background not to hold up reading
+	rules, alerts := s.alerts.Observe(e)
+	for i := range rules {
+		go func(rule config.AlertRule, a alert.Alert) {
+			log.Printf("Alert %s fired: %d events within %s", a.Rule, a.Count, a.Window)
+			if err := alert.Run(rule, a, config.Cfg.WSClient.AlertTimeout); err != nil {
+				log.Printf("Error running alert %s: %s", a.Rule, err)
+			}
+		}(rules[i], alerts[i])
+	}
+
+	if !s.filter.Match(e) {
+		return
+	}
+
+	record, _ := eventsink.Format(e, config.Cfg.WSClient.Format)
+	if err := s.sinks.Write(record); err != nil {
+		log.Println("Error writing event to output: ", err)
+	}
+
+	s.received++
+	if config.Cfg.WSClient.Count > 0 && s.received >= config.Cfg.WSClient.Count {
+		s.finish(0, fmt.Sprintf("Received %d events", s.received))
+	}
+}
+
+// readLastEventID loads ID of the last received event from the state file, zero if there is none
+func readLastEventID(stateFile string) uint64 {
+	if stateFile == "" {
+		return 0
+	}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return 0
+	}
+	lastID, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return lastID
+}
+
+// saveLastEventID replaces the state file with ID of the last received event
+func saveLastEventID(stateFile string, lastID uint64) error {
+	if stateFile == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(stateFile), filepath.Base(stateFile)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.WriteString(strconv.FormatUint(lastID, 10) + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), stateFile)
 }
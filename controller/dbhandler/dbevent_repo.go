@@ -0,0 +1,49 @@
+package dbhandler
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/database"
+	"gorm.io/gorm"
+)
+
+// DbEventRepo represents access to published events
+type DbEventRepo struct {
+	DB *gorm.DB
+}
+
+// NewDbEventRepo creates new database repository for Events
+func NewDbEventRepo() *DbEventRepo {
+	dbEventRepo := new(DbEventRepo)
+	dbEventRepo.DB = database.DB
+
+	return dbEventRepo
+}
+
+// Save stores published event
+func (r *DbEventRepo) Save(e model.Event) error {
+	return r.DB.Create(&e).Error
+}
+
+// Since finds up to limit events published after event with given id, oldest first
+func (r *DbEventRepo) Since(id uint64, limit int) ([]model.Event, error) {
+	var events []model.Event
+
+	if err := r.DB.Where("id > ?", id).Order("id ASC").Limit(limit).
+		Find(&events).Error; err != nil {
+		return []model.Event{}, err
+	}
+
+	return events, nil
+}
+
+// LastID returns ID of the last stored event, zero when there is none
+func (r *DbEventRepo) LastID() (uint64, error) {
+	var lastID uint64
+
+	if err := r.DB.Model(&model.Event{}).Select("COALESCE(MAX(id), 0)").
+		Scan(&lastID).Error; err != nil {
+		return 0, err
+	}
+
+	return lastID, nil
+}
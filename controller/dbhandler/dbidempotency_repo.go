@@ -0,0 +1,91 @@
+package dbhandler
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// DbIdempotencyRepo represents access to responses stored under idempotency keys
+type DbIdempotencyRepo struct {
+	DB *gorm.DB
+}
+
+// NewDbIdempotencyRepo creates new database repository for idempotency keys
+func NewDbIdempotencyRepo() *DbIdempotencyRepo {
+	dbIdempotencyRepo := new(DbIdempotencyRepo)
+	dbIdempotencyRepo.DB = database.DB
+
+	return dbIdempotencyRepo
+}
+
+// Claim stores key k in progress and reports true, unless the key is already stored, not expired at now
+// and not in progress with the lease run out. Then it returns the stored key and false.
+func (r *DbIdempotencyRepo) Claim(k model.IdempotencyKey, now time.Time) (model.IdempotencyKey, bool, error) {
+	// Expired or abandoned key is taken over by the new request, replicas racing for a key are
+	// serialized by the row
+	result := r.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"fingerprint":  k.Fingerprint,
+			"status":       0,
+			"header":       "",
+			"body":         nil,
+			"expires_at":   k.ExpiresAt,
+			"locked_until": k.LockedUntil,
+		}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "idempotency_keys.expires_at <= ? OR " +
+				"(idempotency_keys.status = 0 AND idempotency_keys.locked_until <= ?)",
+				Vars: []interface{}{now, now}},
+		}},
+	}).Create(&k)
+	if result.Error != nil {
+		return model.IdempotencyKey{}, false, translateError(result.Error)
+	}
+	if result.RowsAffected == 1 {
+		return k, true, nil
+	}
+
+	var stored model.IdempotencyKey
+	if err := r.DB.Where("id = ?", k.ID).First(&stored).Error; err != nil {
+		return model.IdempotencyKey{}, false, translateError(err)
+	}
+
+	return stored, false, nil
+}
+
+// Complete stores the response of the request which claimed the key. A key taken over by a retry
+// after the lease ran out is left to the retry and ErrNotFound is returned.
+func (r *DbIdempotencyRepo) Complete(k model.IdempotencyKey) error {
+	result := r.DB.Model(&model.IdempotencyKey{}).
+		Where("id = ? AND status = 0 AND locked_until = ?", k.ID, k.LockedUntil).
+		Updates(map[string]interface{}{
+			"status": k.Status,
+			"header": k.Header,
+			"body":   k.Body,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+// Release removes the key claimed by k, so the request can be retried with it
+func (r *DbIdempotencyRepo) Release(k model.IdempotencyKey) error {
+	return r.DB.Where("id = ? AND status = 0 AND locked_until = ?", k.ID, k.LockedUntil).
+		Delete(&model.IdempotencyKey{}).Error
+}
+
+// DeleteExpired removes keys expired at now and returns how many were removed
+func (r *DbIdempotencyRepo) DeleteExpired(now time.Time) (int64, error) {
+	result := r.DB.Where("expires_at <= ?", now).Delete(&model.IdempotencyKey{})
+
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,67 @@
+package dbhandler
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyLease(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	k := model.IdempotencyKey{ID: "k1", Fingerprint: "f1", ExpiresAt: now.Add(time.Hour),
+		LockedUntil: now.Add(time.Minute)}
+
+	// Stored key in progress is taken over once its lease runs out
+	var affected int64
+	f := &fakeDB{answer: func(query string, args []driver.Value) fakeResult {
+		if strings.HasPrefix(query, `INSERT INTO "idempotency_keys"`) {
+			return fakeResult{affected: 1}
+		}
+		return fakeResult{affected: affected}
+	}}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(f)}),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("Opening fake database: %s", err)
+	}
+	repo := &DbIdempotencyRepo{DB: db}
+
+	if _, claimed, err := repo.Claim(k, now); err != nil || !claimed {
+		t.Fatalf("Claim returned %v, %v", claimed, err)
+	}
+	insert, args := f.statement(`INSERT INTO "idempotency_keys"`)
+	if !strings.Contains(insert, `"locked_until"=$`) ||
+		!strings.Contains(insert, "idempotency_keys.expires_at <= $") ||
+		!strings.Contains(insert, "(idempotency_keys.status = 0 AND idempotency_keys.locked_until <= $") {
+		t.Errorf("Claim statement is wrong: %s", insert)
+	}
+	if len(args) < 2 || args[len(args)-1] != now || args[len(args)-2] != now {
+		t.Errorf("Claim arguments are wrong: %v", args)
+	}
+
+	// Only the claim holding the key completes or releases it
+	if err = repo.Complete(k); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Complete of key taken over returned %v", err)
+	}
+	affected = 1
+	if err = repo.Complete(k); err != nil {
+		t.Errorf("Complete returned %v", err)
+	}
+	if err = repo.Release(k); err != nil {
+		t.Errorf("Release returned %v", err)
+	}
+	for _, prefix := range []string{`UPDATE "idempotency_keys"`, `DELETE FROM "idempotency_keys"`} {
+		if stmt, args := f.statement(prefix); !strings.Contains(stmt, "status = 0 AND locked_until = $") ||
+			len(args) == 0 || args[len(args)-1] != k.LockedUntil {
+			t.Errorf("Statement does not match the claim: %s %v", stmt, args)
+		}
+	}
+}
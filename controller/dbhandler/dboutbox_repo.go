@@ -0,0 +1,103 @@
+package dbhandler
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DbOutboxRepo represents access to events waiting in the outbox
+type DbOutboxRepo struct {
+	DB *gorm.DB
+}
+
+// NewDbOutboxRepo creates new database repository for the outbox
+func NewDbOutboxRepo() *DbOutboxRepo {
+	dbOutboxRepo := new(DbOutboxRepo)
+	dbOutboxRepo.DB = database.DB
+
+	return dbOutboxRepo
+}
+
+// Drain hands up to limit oldest outbox events to relay in order, queues the webhook deliveries
+// relay returns for them and removes them in one transaction. It returns how many were relayed.
+// Events stay in the outbox when relaying, queueing or removing fails.
+func (r *DbOutboxRepo) Drain(limit int, relay func(e model.OutboxEvent) ([]model.WebhookDelivery, error)) (int, error) {
+	var pending []model.OutboxEvent
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the events, relays of other replicas wait instead of publishing them twice or out of order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("id ASC").Limit(limit).
+			Find(&pending).Error; err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		ids := make([]uint64, len(pending))
+		var deliveries []model.WebhookDelivery
+		for i, e := range pending {
+			d, err := relay(e)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d...)
+			ids[i] = e.ID
+		}
+		if err := addDeliveries(tx, deliveries); err != nil {
+			return err
+		}
+
+		return tx.Where("id IN ?", ids).Delete(&model.OutboxEvent{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(pending), nil
+}
+
+// addDeliveries queues deliveries to webhooks which still exist, a webhook deleted by another
+// replica may linger in the webhooks the relay knows
+func addDeliveries(tx *gorm.DB, deliveries []model.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	var existing []uint64
+	if err := tx.Model(&model.Webhook{}).Where("id IN ?", webhookIDs(deliveries)).
+		Pluck("id", &existing).Error; err != nil {
+		return err
+	}
+	exists := make(map[uint64]bool, len(existing))
+	for _, id := range existing {
+		exists[id] = true
+	}
+
+	queued := deliveries[:0]
+	for _, d := range deliveries {
+		if exists[d.WebhookID] {
+			queued = append(queued, d)
+		}
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+
+	return tx.Create(&queued).Error
+}
+
+// webhookIDs lists webhooks of deliveries once
+func webhookIDs(deliveries []model.WebhookDelivery) []uint64 {
+	seen := map[uint64]bool{}
+	var ids []uint64
+	for _, d := range deliveries {
+		if !seen[d.WebhookID] {
+			seen[d.WebhookID] = true
+			ids = append(ids, d.WebhookID)
+		}
+	}
+	return ids
+}
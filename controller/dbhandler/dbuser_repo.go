@@ -3,22 +3,37 @@ package dbhandler
 import (
 	"errors"
 	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/config"
 	"github.com/romanzac/gorilla-feast/infra/database"
+	"github.com/romanzac/gorilla-feast/infra/outbox"
+	"github.com/romanzac/gorilla-feast/infra/pagination"
 	"github.com/romanzac/gorilla-feast/infra/ssha"
 	"github.com/romanzac/gorilla-feast/middleware"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"strconv"
 	"time"
 )
 
+// dummyPwdHash is verified against when the acct is unknown, so a failed login
+// takes the same time whether the user exists or not
+var dummyPwdHash, _ = ssha.GeneratePassword("gorilla-feast-dummy-password", 32)
+
 // DbUserRepo represents access to user data
 type DbUserRepo struct {
-	DB *gorm.DB
+	DB              *gorm.DB
+	Outbox          *outbox.Relay
+	SearchThreshold float64
 }
 
 // NewDbUserRepo creates new database repository for Users
 func NewDbUserRepo() *DbUserRepo {
 	dbUserRepo := new(DbUserRepo)
 	dbUserRepo.DB = database.DB
+	dbUserRepo.Outbox = outbox.Publisher
+	dbUserRepo.SearchThreshold = config.Cfg.Web.SearchThreshold
 
 	return dbUserRepo
 }
@@ -26,7 +41,11 @@ func NewDbUserRepo() *DbUserRepo {
 func (r *DbUserRepo) Find(acct, fullname, sortQuery string, limit, offset int, noDetail bool) ([]model.User, error) {
 	var users []model.User
 
-	if acct == "" && fullname == "" && sortQuery != "" && limit != 0 && offset != 0 {
+	// Negative limit and offset cancel them
+	if acct == "" && fullname == "" {
+		if sortQuery == "" {
+			sortQuery = "acct ASC"
+		}
 		if err := r.DB.Select("acct", "fullname").
 			Limit(limit).Offset(offset).Order(sortQuery).Find(&users).Error; err != nil {
 			return []model.User{}, err
@@ -35,7 +54,7 @@ func (r *DbUserRepo) Find(acct, fullname, sortQuery string, limit, offset int, n
 	}
 
 	if acct != "" && noDetail == false {
-		if err := database.DB.Select("acct", "fullname", "created_at", "updated_at").
+		if err := database.DB.Select("acct", "fullname", "role", "created_at", "updated_at", "version").
 			Where("acct = ?", acct).Find(&users).Error; err != nil {
 			return []model.User{}, err
 		}
@@ -61,70 +80,299 @@ func (r *DbUserRepo) Find(acct, fullname, sortQuery string, limit, offset int, n
 	return []model.User{}, errors.New("invalid query")
 }
 
+// FindPage reads one page of users with keyset pagination, so pages stay stable and fast
+// while users are added. Columns of sort keys are read besides acct and fullname.
+func (r *DbUserRepo) FindPage(q repository.UserPageQuery) (repository.UserPage, error) {
+	page := repository.UserPage{Total: -1}
+
+	users := r.DB.Model(&model.User{})
+	if q.Filter != "" {
+		users = users.Where(q.Filter, q.FilterArgs...)
+	}
+	users = users.Session(&gorm.Session{})
+
+	if q.Count {
+		if err := users.Count(&page.Total).Error; err != nil {
+			return page, err
+		}
+	}
+
+	columns := []string{"acct", "fullname"}
+	for _, k := range q.Sort {
+		if k.Column != "acct" && k.Column != "fullname" {
+			columns = append(columns, k.Column)
+		}
+	}
+
+	query, err := pageQuery(users.Select(columns), q)
+	if err != nil {
+		return page, err
+	}
+	if err = query.Find(&page.Users).Error; err != nil {
+		return page, err
+	}
+	if len(page.Users) > q.Limit {
+		page.Users, page.More = page.Users[:q.Limit], true
+	}
+
+	// Backward reading returns users in reverse order
+	if q.Before {
+		for i, j := 0, len(page.Users)-1; i < j; i, j = i+1, j-1 {
+			page.Users[i], page.Users[j] = page.Users[j], page.Users[i]
+		}
+	}
+
+	return page, nil
+}
+
+// Search reads one page of users whose acct or fullname resembles text, ignoring case and accents
+// and tolerating typos. Rank is word similarity of text to the best matching part of acct and fullname,
+// users below SearchThreshold are left out.
+func (r *DbUserRepo) Search(text string, q repository.UserPageQuery) (repository.UserSearchPage, error) {
+	page := repository.UserSearchPage{Total: -1}
+
+	// Trigram index on the normalized document serves the <% operator
+	doc := "immutable_unaccent(lower(acct || ' ' || COALESCE(fullname, '')))"
+	needle := "immutable_unaccent(lower(?))"
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT set_config('pg_trgm.word_similarity_threshold', ?, true)",
+			strconv.FormatFloat(r.SearchThreshold, 'f', -1, 64)).Error; err != nil {
+			return err
+		}
+
+		matches := tx.Model(&model.User{}).
+			Select("acct, fullname, word_similarity("+needle+", "+doc+") AS rank", text).
+			Where(needle+" <% "+doc, text)
+		if q.Filter != "" {
+			matches = matches.Where(q.Filter, q.FilterArgs...)
+		}
+		ranked := tx.Table("(?) AS matches", matches).Session(&gorm.Session{})
+
+		if q.Count {
+			if err := ranked.Count(&page.Total).Error; err != nil {
+				return err
+			}
+		}
+
+		query, err := pageQuery(ranked.Select("acct, fullname, rank"), q)
+		if err != nil {
+			return err
+		}
+		return query.Find(&page.Matches).Error
+	})
+	if err != nil {
+		return page, err
+	}
+
+	if len(page.Matches) > q.Limit {
+		page.Matches, page.More = page.Matches[:q.Limit], true
+	}
+	if q.Before {
+		for i, j := 0, len(page.Matches)-1; i < j; i, j = i+1, j-1 {
+			page.Matches[i], page.Matches[j] = page.Matches[j], page.Matches[i]
+		}
+	}
+
+	return page, nil
+}
+
+// pageQuery orders query by the sort keys and selects rows after or before the cursor values,
+// one more than the page size tells whether another page follows
+func pageQuery(query *gorm.DB, q repository.UserPageQuery) (*gorm.DB, error) {
+	query = query.Order(pagination.Order(q.Sort, q.Before)).Limit(q.Limit + 1)
+	if len(q.After) > 0 {
+		cond, args, err := pagination.Keyset(q.Sort, q.After, q.Before)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(cond, args...)
+	}
+	return query, nil
+}
+
 func (r *DbUserRepo) Create(acct, fullname, pwd string) error {
 	var u model.User
 	u.Acct = acct
 	u.Fullname = fullname
 
 	u.Pwd, _ = ssha.GeneratePassword(pwd, 32)
-	if err := r.DB.Create(&u).Error; err != nil {
-		return err
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&u).Error; err != nil {
+			return err
+		}
+		return addOutboxEvent(tx, model.TopicUserCreated, acct, "")
+	})
+	if err != nil {
+		return translateError(err)
 	}
 
+	r.Outbox.Notify()
+
 	return nil
 }
 
-func (r *DbUserRepo) Update(acct, fullname, pwd string) error {
+func (r *DbUserRepo) Update(acct, fullname, pwd string, versions []repository.UserVersion) (repository.UserVersion, error) {
 	var u model.User
 
-	pwd, _ = ssha.GeneratePassword(pwd, 32)
+	// Every update bumps the version, empty values are left unchanged
+	changes := map[string]interface{}{"updated_at": time.Now(), "version": gorm.Expr("version + 1")}
+	if fullname != "" {
+		changes["fullname"] = fullname
+	}
+	if pwd != "" {
+		changes["pwd"], _ = ssha.GeneratePassword(pwd, 32)
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		returning := clause.Returning{Columns: []clause.Column{{Name: "created_at"}, {Name: "version"}}}
+		query := tx.Model(&u).Clauses(returning).Where("acct = ?", acct)
+		result := whereVersion(query, versions).Updates(changes)
 
-	t := time.Now()
-	result := database.DB.Model(&u).Where("acct = ?", acct).
-		Updates(model.User{Pwd: pwd, Fullname: fullname, UpdatedAt: &t})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return missingUser(tx, acct, versions)
+		}
 
-	if result.RowsAffected == 0 {
-		return errors.New("no rows were affected")
+		return addOutboxEvent(tx, model.TopicUserUpdated, acct, changedFields(fullname, pwd))
+	})
+	if err != nil {
+		return repository.UserVersion{}, translateError(err)
 	}
-	if result.Error != nil {
-		return result.Error
 
+	r.Outbox.Notify()
+
+	return repository.UserVersion{CreatedAt: *u.CreatedAt, Version: u.Version}, nil
+}
+
+func (r *DbUserRepo) Delete(acct string, versions []repository.UserVersion) error {
+	var u model.User
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		result := whereVersion(tx.Where("acct = ?", acct), versions).Delete(&u)
+
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return missingUser(tx, acct, versions)
+		}
+
+		return addOutboxEvent(tx, model.TopicUserDeleted, acct, "")
+	})
+	if err != nil {
+		return translateError(err)
 	}
 
+	r.Outbox.Notify()
+
 	return nil
 }
 
-func (r *DbUserRepo) Delete(acct string) error {
-	var u model.User
+// whereVersion selects user in one of versions, any version when versions are nil
+func whereVersion(query *gorm.DB, versions []repository.UserVersion) *gorm.DB {
+	if versions == nil {
+		return query
+	}
+	if len(versions) == 0 {
+		return query.Where("FALSE")
+	}
 
-	result := database.DB.Where("acct = ?", acct).Delete(&u)
+	pairs := make([][]interface{}, len(versions))
+	for i, v := range versions {
+		pairs[i] = []interface{}{v.CreatedAt, v.Version}
+	}
+	return query.Where("(created_at, version) IN ?", pairs)
+}
+
+// missingUser tells why no user was changed: it does not exist or it has another version
+func missingUser(tx *gorm.DB, acct string, versions []repository.UserVersion) error {
+	if versions == nil {
+		return repository.ErrNotFound
+	}
 
-	if result.RowsAffected == 0 {
-		return errors.New("nothing was deleted")
+	var count int64
+	if err := tx.Model(&model.User{}).Where("acct = ?", acct).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return repository.ErrNotFound
 	}
-	if result.Error != nil {
-		return result.Error
+	return repository.ErrPreconditionFailed
+}
 
+// AddEvent writes event which comes with no change to the outbox, so it goes out in order with others
+func (r *DbUserRepo) AddEvent(topic, acct, detail string) error {
+	if err := addOutboxEvent(r.DB, topic, acct, detail); err != nil {
+		return translateError(err)
 	}
 
+	r.Outbox.Notify()
+
 	return nil
 }
 
+// rehashPwd replaces hash of the password sent before normalization with one of normalized pwd
+// unless the password was changed meanwhile. It is no change of the user, so the version stays.
+func (r *DbUserRepo) rehashPwd(acct, oldHash, pwd string) {
+	hash, err := ssha.GeneratePassword(pwd, 32)
+	if err == nil {
+		err = r.DB.Model(&model.User{}).Where("acct = ? AND pwd = ?", acct, oldHash).
+			UpdateColumn("pwd", hash).Error
+	}
+	if err != nil {
+		log.Printf("Error rehashing normalized password of %s: %s", acct, err)
+	}
+}
+
+// addOutboxEvent writes event to the outbox within transaction of the change it describes
+func addOutboxEvent(tx *gorm.DB, topic, acct, detail string) error {
+	return tx.Create(&model.OutboxEvent{Type: topic, Acct: acct, Time: time.Now(), Detail: detail}).Error
+}
+
+// changedFields describes which fields an update has changed
+func changedFields(fullname, pwd string) string {
+	switch {
+	case fullname != "" && pwd != "":
+		return "fullname,pwd"
+	case fullname != "":
+		return "fullname"
+	}
+	return "pwd"
+}
+
 // Validate user for login purposes, return JWT token if passed
-func (r *DbUserRepo) Validate(acct, pwd string) (middleware.JWTToken, error) {
+func (r *DbUserRepo) Validate(acct, pwd, rawPwd string) (middleware.JWTToken, error) {
 	var u model.User
 
-	if err := r.DB.Select("acct", "pwd", "fullname").
-		Where("acct = ?", acct).First(&u).Error; err != nil {
-		return middleware.JWTToken{}, errors.New("DB query error to find user \"" + acct + "\"")
+	err := r.DB.Select("acct", "pwd", "fullname", "role").
+		Where("acct = ?", acct).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Burn the same hashing time as for a known acct before giving up
+		_, _ = ssha.ValidatePassword(pwd, dummyPwdHash)
+		if rawPwd != pwd {
+			_, _ = ssha.ValidatePassword(rawPwd, dummyPwdHash)
+		}
+		return middleware.JWTToken{}, &repository.CredentialsError{Acct: acct, Reason: "User not found"}
+	}
+	if err != nil {
+		return middleware.JWTToken{}, errors.New("DB query error to find user \"" + acct + "\": " + err.Error())
 	}
 
 	pwdOK, _ := ssha.ValidatePassword(pwd, u.Pwd)
+	if !pwdOK && rawPwd != pwd {
+		// Hash made before passwords were normalized to NFC
+		if pwdOK, _ = ssha.ValidatePassword(rawPwd, u.Pwd); pwdOK {
+			r.rehashPwd(acct, u.Pwd, pwd)
+		}
+	}
 	if !pwdOK {
-		return middleware.JWTToken{}, errors.New("Password incorrect for user \"" + acct + "\"")
+		return middleware.JWTToken{}, &repository.CredentialsError{Acct: acct, Reason: "Password incorrect"}
 	}
 
-	token, err := middleware.GenerateJWT(u.Acct, u.Fullname)
+	token, err := middleware.GenerateJWT(u.Acct, u.Fullname, u.Role)
 	if err != nil {
 		return middleware.JWTToken{}, errors.New("Error: " + err.Error())
 	}
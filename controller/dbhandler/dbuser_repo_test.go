@@ -0,0 +1,195 @@
+package dbhandler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResult is the answer of fake database to one statement
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// fakeDB answers statements with results of answer and records them, so repositories can be tested
+// without Postgres
+type fakeDB struct {
+	mu         sync.Mutex
+	answer     func(query string, args []driver.Value) fakeResult
+	statements []string
+	args       [][]driver.Value
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+func (f *fakeDB) run(query string, named []driver.NamedValue) fakeResult {
+	args := make([]driver.Value, len(named))
+	for i, a := range named {
+		args[i] = a.Value
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements, f.args = append(f.statements, query), append(f.args, args)
+	return f.answer(query, args)
+}
+
+// record records statement which gets no answer, e.g. start and end of transactions
+func (f *fakeDB) record(query string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements, f.args = append(f.statements, query), append(f.args, nil)
+}
+
+// statement returns the recorded statement starting with prefix and its arguments
+func (f *fakeDB) statement(prefix string) (string, []driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, s := range f.statements {
+		if strings.HasPrefix(s, prefix) {
+			return s, f.args[i]
+		}
+	}
+	return "", nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { c.db.record("BEGIN"); return c, nil }
+func (c *fakeConn) Commit() error             { c.db.record("COMMIT"); return nil }
+func (c *fakeConn) Rollback() error           { c.db.record("ROLLBACK"); return nil }
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res := c.db.run(query, args)
+	return &fakeRows{columns: res.columns, rows: res.rows}, nil
+}
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(c.db.run(query, args).affected), nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newFakeUserRepo creates user repository on fake database
+func newFakeUserRepo(t *testing.T, answer func(query string, args []driver.Value) fakeResult) (*DbUserRepo, *fakeDB) {
+	f := &fakeDB{answer: answer}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(f)}),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("Opening fake database: %s", err)
+	}
+	return &DbUserRepo{DB: db}, f
+}
+
+// userAnswer answers changes of user with rows changed and counts of users with count,
+// outbox events get IDs
+func userAnswer(changed [][]driver.Value, count int64) func(string, []driver.Value) fakeResult {
+	return func(query string, args []driver.Value) fakeResult {
+		switch {
+		case strings.HasPrefix(query, `UPDATE "users"`):
+			return fakeResult{columns: []string{"created_at", "version"}, rows: changed}
+		case strings.HasPrefix(query, `DELETE FROM "users"`):
+			return fakeResult{affected: int64(len(changed))}
+		case strings.HasPrefix(query, "SELECT count(*)"):
+			return fakeResult{columns: []string{"count"}, rows: [][]driver.Value{{count}}}
+		case strings.HasPrefix(query, `INSERT INTO "outbox_events"`):
+			return fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}
+		}
+		return fakeResult{}
+	}
+}
+
+func TestUpdateVersion(t *testing.T) {
+	created := time.Date(2024, 1, 1, 12, 0, 0, 123456000, time.UTC)
+	stale := repository.UserVersion{CreatedAt: created, Version: 2}
+	current := repository.UserVersion{CreatedAt: created, Version: 3}
+
+	// New version comes from RETURNING of the update matching creation time and version
+	repo, f := newFakeUserRepo(t, userAnswer([][]driver.Value{{created, int64(4)}}, 1))
+	v, err := repo.Update("jacky_yang", "Jacky Yang", "", []repository.UserVersion{stale, current})
+	if err != nil || !v.CreatedAt.Equal(created) || v.Version != 4 {
+		t.Fatalf("Update returned %+v, %v", v, err)
+	}
+	update, args := f.statement(`UPDATE "users"`)
+	if !strings.Contains(update, "(created_at, version) IN (($") ||
+		!strings.Contains(update, `RETURNING "created_at","version"`) {
+		t.Errorf("Update statement is wrong: %s", update)
+	}
+	if len(args) < 4 || args[len(args)-1] != int64(3) || args[len(args)-3] != int64(2) {
+		t.Errorf("Update arguments are wrong: %v", args)
+	}
+	if insert, _ := f.statement(`INSERT INTO "outbox_events"`); insert == "" {
+		t.Errorf("Update wrote no event")
+	}
+
+	// Missing user is told apart from user of another version
+	tests := []struct {
+		name     string
+		count    int64
+		versions []repository.UserVersion
+		want     error
+	}{
+		{"stale version", 1, []repository.UserVersion{stale}, repository.ErrPreconditionFailed},
+		{"deleted user", 0, []repository.UserVersion{current}, repository.ErrNotFound},
+		{"unconditional change of missing user", 1, nil, repository.ErrNotFound},
+	}
+	for _, tt := range tests {
+		repo, f = newFakeUserRepo(t, userAnswer(nil, tt.count))
+		if _, err = repo.Update("jacky_yang", "Jacky Yang", "", tt.versions); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Update returned %v, want %v", tt.name, err, tt.want)
+		}
+		if err = repo.Delete("jacky_yang", tt.versions); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Delete returned %v, want %v", tt.name, err, tt.want)
+		}
+		if insert, _ := f.statement(`INSERT INTO "outbox_events"`); insert != "" {
+			t.Errorf("%s: event was written without change", tt.name)
+		}
+	}
+
+	// Delete matches creation time and version too
+	repo, f = newFakeUserRepo(t, userAnswer([][]driver.Value{{created, int64(3)}}, 1))
+	if err = repo.Delete("jacky_yang", []repository.UserVersion{current}); err != nil {
+		t.Fatalf("Delete returned %v", err)
+	}
+	if del, _ := f.statement(`DELETE FROM "users"`); !strings.Contains(del, "(created_at, version) IN (($") {
+		t.Errorf("Delete statement is wrong: %s", del)
+	}
+
+	// No version matches empty versions
+	repo, f = newFakeUserRepo(t, userAnswer(nil, 1))
+	err = repo.Delete("jacky_yang", []repository.UserVersion{})
+	if !errors.Is(err, repository.ErrPreconditionFailed) {
+		t.Errorf("Delete with empty versions returned %v", err)
+	}
+	if del, _ := f.statement(`DELETE FROM "users"`); !strings.Contains(del, "FALSE") {
+		t.Errorf("Delete statement with empty versions is wrong: %s", del)
+	}
+}
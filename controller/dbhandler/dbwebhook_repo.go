@@ -0,0 +1,183 @@
+package dbhandler
+
+import (
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// DbWebhookRepo represents access to webhooks and their dead letters
+type DbWebhookRepo struct {
+	DB *gorm.DB
+}
+
+// NewDbWebhookRepo creates new database repository for Webhooks
+func NewDbWebhookRepo() *DbWebhookRepo {
+	dbWebhookRepo := new(DbWebhookRepo)
+	dbWebhookRepo.DB = database.DB
+
+	return dbWebhookRepo
+}
+
+func (r *DbWebhookRepo) FindAll() ([]model.Webhook, error) {
+	var hooks []model.Webhook
+
+	if err := r.DB.Order("id ASC").Find(&hooks).Error; err != nil {
+		return []model.Webhook{}, err
+	}
+
+	return hooks, nil
+}
+
+func (r *DbWebhookRepo) Find(id uint64) (model.Webhook, error) {
+	var hook model.Webhook
+
+	if err := r.DB.Where("id = ?", id).First(&hook).Error; err != nil {
+		return model.Webhook{}, translateError(err)
+	}
+
+	return hook, nil
+}
+
+func (r *DbWebhookRepo) Create(url, eventTypes, secret string) (model.Webhook, error) {
+	hook := model.Webhook{URL: url, EventTypes: eventTypes, Secret: secret}
+
+	if err := r.DB.Create(&hook).Error; err != nil {
+		return model.Webhook{}, err
+	}
+
+	return hook, nil
+}
+
+func (r *DbWebhookRepo) Delete(id uint64) error {
+	result := r.DB.Where("id = ?", id).Delete(&model.Webhook{})
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// errLeaseLost occurs when delivery was deleted with its webhook or its lease expired before the attempt
+// ended, the result of the attempt is dropped then
+var errLeaseLost = errors.New("webhook delivery was deleted or its lease expired during the attempt")
+
+// AttemptDelivery leases the oldest due delivery of a webhook which no other worker attempts, hands it
+// to attempt outside any transaction and applies the result. It reports whether there was a delivery
+// to attempt. The lease keeps workers of all replicas off the webhook until the attempt ends or lease
+// passes, so slow webhooks hold neither row locks nor database connections.
+func (r *DbWebhookRepo) AttemptDelivery(now time.Time, lease time.Duration,
+	attempt func(hook model.Webhook, d *model.WebhookDelivery) repository.DeliveryResult) (bool, error) {
+	var (
+		d    model.WebhookDelivery
+		hook model.Webhook
+	)
+	leasedUntil := now.Add(lease).Round(0).Truncate(time.Microsecond)
+
+	found := false
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		// Only the oldest delivery of a webhook can be attempted, so webhooks get events in order.
+		// Leased delivery is not due until its lease passes, so later ones of its webhook wait.
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("next_attempt_at <= ?", now).
+			Where("NOT EXISTS (SELECT 1 FROM webhook_deliveries older " +
+				"WHERE older.webhook_id = webhook_deliveries.webhook_id AND older.id < webhook_deliveries.id)").
+			Order("next_attempt_at ASC, id ASC").Limit(1).Find(&d)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		found = true
+
+		if err := tx.Where("id = ?", d.WebhookID).First(&hook).Error; err != nil {
+			return err
+		}
+		return tx.Model(&d).UpdateColumn("next_attempt_at", leasedUntil).Error
+	})
+	if err != nil || !found {
+		return found, translateError(err)
+	}
+
+	res := attempt(hook, &d)
+
+	// Result applies only to delivery still leased by this attempt
+	err = r.DB.Transaction(func(tx *gorm.DB) error {
+		leased := tx.Where("id = ? AND next_attempt_at = ?", d.ID, leasedUntil)
+		if res == repository.DeliveryRetried {
+			result := leased.Model(&model.WebhookDelivery{}).Updates(map[string]interface{}{
+				"attempts":        d.Attempts,
+				"last_error":      d.LastError,
+				"next_attempt_at": d.NextAttemptAt,
+			})
+			if result.Error == nil && result.RowsAffected == 0 {
+				return errLeaseLost
+			}
+			return result.Error
+		}
+
+		result := leased.Delete(&model.WebhookDelivery{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errLeaseLost
+		}
+		if res == repository.DeliveryFailed {
+			return tx.Create(&model.WebhookDeadLetter{
+				WebhookID: d.WebhookID,
+				EventID:   d.EventID,
+				Payload:   d.Payload,
+				Attempts:  d.Attempts,
+				LastError: d.LastError,
+			}).Error
+		}
+		return nil
+	})
+
+	return true, translateError(err)
+}
+
+func (r *DbWebhookRepo) FindDeadLetters() ([]model.WebhookDeadLetter, error) {
+	var deadLetters []model.WebhookDeadLetter
+
+	if err := r.DB.Order("id ASC").Find(&deadLetters).Error; err != nil {
+		return []model.WebhookDeadLetter{}, err
+	}
+
+	return deadLetters, nil
+}
+
+func (r *DbWebhookRepo) FindDeadLetter(id uint64) (model.WebhookDeadLetter, error) {
+	var deadLetter model.WebhookDeadLetter
+
+	if err := r.DB.Where("id = ?", id).First(&deadLetter).Error; err != nil {
+		return model.WebhookDeadLetter{}, translateError(err)
+	}
+
+	return deadLetter, nil
+}
+
+// RequeueDeadLetter removes dead letter and queues delivery d in its place in one transaction,
+// so the dead letter is kept when queueing fails and redelivered only once
+func (r *DbWebhookRepo) RequeueDeadLetter(id uint64, d model.WebhookDelivery) error {
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ?", id).Delete(&model.WebhookDeadLetter{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return repository.ErrNotFound
+		}
+
+		return tx.Create(&d).Error
+	})
+
+	return translateError(err)
+}
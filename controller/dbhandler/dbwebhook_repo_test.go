@@ -0,0 +1,102 @@
+package dbhandler
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttemptDelivery(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	leasedUntil := now.Add(time.Minute)
+
+	tests := []struct {
+		name       string
+		result     repository.DeliveryResult
+		affected   int64
+		statement  string
+		deadLetter bool
+		err        error
+	}{
+		{"succeeded", repository.DeliverySucceeded, 1, `DELETE FROM "webhook_deliveries"`, false, nil},
+		{"retried", repository.DeliveryRetried, 1, `UPDATE "webhook_deliveries" SET "attempts"`, false, nil},
+		{"failed", repository.DeliveryFailed, 1, `DELETE FROM "webhook_deliveries"`, true, nil},
+		{"lease lost", repository.DeliveryFailed, 0, `DELETE FROM "webhook_deliveries"`, false, errLeaseLost},
+	}
+	for _, tt := range tests {
+		f := &fakeDB{answer: func(query string, args []driver.Value) fakeResult {
+			switch {
+			case strings.HasPrefix(query, `SELECT * FROM "webhook_deliveries"`):
+				return fakeResult{columns: []string{"id", "webhook_id", "event_id", "next_attempt_at"},
+					rows: [][]driver.Value{{int64(3), int64(1), int64(7), now}}}
+			case strings.HasPrefix(query, `SELECT * FROM "webhooks"`):
+				return fakeResult{columns: []string{"id", "url"}, rows: [][]driver.Value{{int64(1), "http://hook"}}}
+			case strings.HasPrefix(query, `UPDATE "webhook_deliveries" SET "next_attempt_at"`):
+				return fakeResult{affected: 1}
+			case strings.HasPrefix(query, `INSERT INTO "webhook_dead_letters"`):
+				return fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}
+			}
+			return fakeResult{affected: tt.affected}
+		}}
+		db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(f)}),
+			&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		if err != nil {
+			t.Fatalf("Opening fake database: %s", err)
+		}
+		repo := &DbWebhookRepo{DB: db}
+
+		// Delivery is leased and the lease committed before the attempt
+		found, err := repo.AttemptDelivery(now, time.Minute,
+			func(hook model.Webhook, d *model.WebhookDelivery) repository.DeliveryResult {
+				f.mu.Lock()
+				last := f.statements[len(f.statements)-1]
+				f.mu.Unlock()
+				if last != "COMMIT" {
+					t.Errorf("%s: attempt runs in transaction, last statement is %s", tt.name, last)
+				}
+				if hook.ID != 1 || d.ID != 3 {
+					t.Errorf("%s: attempt got webhook %d and delivery %d", tt.name, hook.ID, d.ID)
+				}
+				d.Attempts++
+				return tt.result
+			})
+		if !found || !errors.Is(err, tt.err) {
+			t.Errorf("%s: AttemptDelivery returned %v, %v", tt.name, found, err)
+		}
+		lease, args := f.statement(`UPDATE "webhook_deliveries" SET "next_attempt_at"`)
+		if lease == "" || len(args) == 0 || args[0] != leasedUntil {
+			t.Errorf("%s: delivery was not leased: %s %v", tt.name, lease, args)
+		}
+
+		// Result applies to the delivery of the lease only
+		stmt, args := f.statement(tt.statement)
+		if !strings.Contains(stmt, "id = $") || !strings.Contains(stmt, "next_attempt_at = $") ||
+			len(args) == 0 || args[len(args)-1] != leasedUntil {
+			t.Errorf("%s: result does not match the lease: %s %v", tt.name, stmt, args)
+		}
+		if insert, _ := f.statement(`INSERT INTO "webhook_dead_letters"`); (insert != "") != tt.deadLetter {
+			t.Errorf("%s: dead letter written %v, want %v", tt.name, insert != "", tt.deadLetter)
+		}
+	}
+
+	// No due delivery is no attempt
+	f := &fakeDB{answer: func(string, []driver.Value) fakeResult { return fakeResult{} }}
+	db, _ := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(f)}),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	found, err := (&DbWebhookRepo{DB: db}).AttemptDelivery(now, time.Minute,
+		func(model.Webhook, *model.WebhookDelivery) repository.DeliveryResult {
+			t.Errorf("Attempt without due delivery")
+			return repository.DeliverySucceeded
+		})
+	if found || err != nil {
+		t.Errorf("AttemptDelivery without due delivery returned %v, %v", found, err)
+	}
+}
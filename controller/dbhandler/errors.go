@@ -0,0 +1,37 @@
+package dbhandler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"gorm.io/gorm"
+)
+
+// Postgres error codes translated to domain errors
+const (
+	pgUniqueViolation      = "23505"
+	pgForeignKeyViolation  = "23503"
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+// translateError turns missing records and Postgres constraint and concurrency errors
+// into domain errors, other errors are returned as they are
+func translateError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return repository.ErrNotFound
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch pgErr.Code {
+	case pgUniqueViolation:
+		return repository.ErrAlreadyExists
+	case pgForeignKeyViolation, pgSerializationFailure, pgDeadlockDetected:
+		return fmt.Errorf("%w: %s", repository.ErrConflict, pgErr.Message)
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package dbhandler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"gorm.io/gorm"
+	"testing"
+)
+
+func TestTranslateError(t *testing.T) {
+	other := errors.New("connection refused")
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"record not found", gorm.ErrRecordNotFound, repository.ErrNotFound},
+		{"wrapped record not found", fmt.Errorf("finding user: %w", gorm.ErrRecordNotFound), repository.ErrNotFound},
+		{"unique violation", &pgconn.PgError{Code: pgUniqueViolation}, repository.ErrAlreadyExists},
+		{"foreign key violation", &pgconn.PgError{Code: pgForeignKeyViolation}, repository.ErrConflict},
+		{"serialization failure", &pgconn.PgError{Code: pgSerializationFailure}, repository.ErrConflict},
+		{"deadlock detected", &pgconn.PgError{Code: pgDeadlockDetected}, repository.ErrConflict},
+		{"other Postgres error", &pgconn.PgError{Code: "42P01"}, nil},
+		{"other error", other, other},
+	}
+	for _, tt := range tests {
+		got := translateError(tt.err)
+		if tt.want == nil {
+			if got != tt.err {
+				t.Errorf("%s: translated to %v, want it unchanged", tt.name, got)
+			}
+			continue
+		}
+		if !errors.Is(got, tt.want) {
+			t.Errorf("%s: translated to %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
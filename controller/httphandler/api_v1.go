@@ -3,28 +3,41 @@ package httphandler
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
 	"github.com/romanzac/gorilla-feast/controller/dbhandler"
+	"github.com/romanzac/gorilla-feast/domain/model"
 	"github.com/romanzac/gorilla-feast/domain/repository"
-	"github.com/romanzac/gorilla-feast/infra/router"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"github.com/romanzac/gorilla-feast/infra/pagination"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"github.com/romanzac/gorilla-feast/infra/validation"
+	"github.com/romanzac/gorilla-feast/infra/webhook"
 	"log"
 	"net/http"
-	"regexp"
-	"strconv"
-	"strings"
+	"unicode/utf8"
 )
 
 // APIv1 implements APIv1 handlers
 type APIv1 struct {
-	UserRepo repository.UserRepository
+	UserRepo    repository.UserRepository
+	WebhookRepo repository.WebhookRepository
+	Events      *eventbus.Bus
+	Webhooks    *webhook.Dispatcher
+	rules       *validation.Rules
+	lockout     *loginLockout
 }
 
 // NewAPIv1 creates new API V1
-func NewAPIv1(userRepo *dbhandler.DbUserRepo) *APIv1 {
+func NewAPIv1(userRepo *dbhandler.DbUserRepo, webhookRepo *dbhandler.DbWebhookRepo) *APIv1 {
 	apiV1 := new(APIv1)
 	apiV1.UserRepo = userRepo
+	apiV1.WebhookRepo = webhookRepo
+	apiV1.Events = eventbus.Events
+	apiV1.Webhooks = webhook.Deliveries
+	apiV1.rules = validation.Users
+	apiV1.lockout = newLoginLockout(config.Cfg.Web.LockoutThreshold,
+		config.Cfg.Web.LockoutWindow, config.Cfg.Web.LockoutDuration)
 
 	return apiV1
 }
@@ -32,172 +45,181 @@ func NewAPIv1(userRepo *dbhandler.DbUserRepo) *APIv1 {
 // PingPong to test API is alive
 func (a *APIv1) PingPong(w http.ResponseWriter, r *http.Request) {
 	if _, err := w.Write([]byte("Pong!\n")); err != nil {
-		http.Error(w, "Error encoding response object", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 	}
 }
 
 // SignupUser implements user registration with password encoding
 func (a *APIv1) SignupUser(w http.ResponseWriter, r *http.Request) {
-
-	acct := r.FormValue("acct")
-	fullname := r.FormValue("fullname")
-	pwd := r.FormValue("pwd")
-
-	// Validate acct(username)
-	reAcct := regexp.MustCompile("^([a-z_][a-z0-9_]{3,30})$")
-	if !reAcct.MatchString(acct) {
-		http.Error(w, "Acct is not valid username", http.StatusBadRequest)
+	var in signupInput
+	if !readInput(w, r, &in) {
 		return
 	}
 
-	// Validate fullname
-	reFullname := regexp.MustCompile("^([A-Z][a-z]{0,40}\\s{1,10}[A-Z][a-z]{0,49})$")
-	if !reFullname.MatchString(fullname) {
-		http.Error(w, "Fullname does not follow pattern: \"Jacky Yang\"", http.StatusBadRequest)
-		return
-	}
+	// Validate acct(username), which must not be reserved, fullname and password
+	var invalid []problem.InvalidParam
+	acct, err := a.rules.NewAcct(in.Acct)
+	invalid = appendInvalid(invalid, err)
+	fullname, err := a.rules.Fullname(in.Fullname)
+	invalid = appendInvalid(invalid, err)
+	pwd, err := a.rules.Pwd(in.Pwd)
+	invalid = appendInvalid(invalid, err)
 
-	// Validate password for length
-	if len(pwd) < 8 {
-		http.Error(w, "Password length is less than 8 characters", http.StatusBadRequest)
+	if len(invalid) > 0 {
+		problem.Invalid(w, r, invalid...)
 		return
 	}
 
-	err := a.UserRepo.Create(r.FormValue("acct"), r.FormValue("fullname"), r.FormValue("pwd"))
-	if err != nil {
-		http.Error(w, "Error adding user to database", http.StatusInternalServerError)
+	err = a.UserRepo.Create(acct, fullname, pwd)
+	if errors.Is(err, repository.ErrAlreadyExists) && config.Cfg.Web.ConcealSignupConflict {
+		// Answer like a successful signup, so the response does not reveal the acct exists
+		log.Printf("Signup conflict concealed for user \"%s\"", acct)
+	} else if err != nil {
+		repositoryError(w, r, err, "User")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err = json.NewEncoder(w).Encode("User created successfully"); err != nil {
-		http.Error(w, "Error encoding response object", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 	}
 }
 
-// LoginFailures reports user login failures to websocket client
-func (a *APIv1) LoginFailures(w http.ResponseWriter, r *http.Request) {
-
-	// Upgrade connection to websocket
-	c, err := router.Upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Print("Upgrade to websocket connection has failed:", err)
-		return
-	}
-
-	// Defer close connection without waiting
-	defer func(c *websocket.Conn) {
-		err := c.Close()
-		if err != nil {
-		}
-	}(c)
-
-	// Wait and send login failures to the client
-	for {
-		message := <-router.LoginFailuresCh
-		err = c.WriteMessage(websocket.TextMessage, []byte(message))
-		if err != nil {
-			log.Println("Write to websocket failed:", err)
-			break
-		}
+// publish writes login event to the outbox, it goes to subscribers and webhooks in order with user events
+func (a *APIv1) publish(topic, acct, detail string) {
+	if err := a.UserRepo.AddEvent(topic, acct, detail); err != nil {
+		log.Printf("Error writing %s event of %s: %s", topic, acct, err)
 	}
 }
 
 // Login with JWT generation
 func (a *APIv1) Login(w http.ResponseWriter, r *http.Request) {
+	var in loginInput
+	if !readInput(w, r, &in) {
+		return
+	}
 
-	acct := r.FormValue("acct")
-	pwd := r.FormValue("pwd")
+	// Validate acct(username) and password
+	var invalid []problem.InvalidParam
+	acct, err := a.rules.Acct(in.Acct)
+	invalid = appendInvalid(invalid, err)
+	pwd, err := a.rules.LoginPwd(in.Pwd)
+	invalid = appendInvalid(invalid, err)
 
-	// Validate acct(username)
-	reAcct := regexp.MustCompile("^([a-z_][a-z0-9_]{3,30})$")
-	if !reAcct.MatchString(acct) {
-		http.Error(w, "Acct is not valid username", http.StatusBadRequest)
+	if len(invalid) > 0 {
+		problem.Invalid(w, r, invalid...)
 		return
 	}
 
-	// Validate password for length
-	if len(pwd) < 8 {
-		http.Error(w, "Password length is less than 8 characters", http.StatusBadRequest)
+	// Validate even locked acct, so the response takes the same time
+	token, err := a.UserRepo.Validate(acct, pwd, in.Pwd)
+	if err == nil && a.lockout.Locked(acct) {
+		err = &repository.CredentialsError{Acct: acct, Reason: "Account locked"}
+	}
+	if errors.Is(err, repository.ErrInvalidCredentials) {
+		// Keep the detailed reason in logs and events only
+		log.Println("Login failed:", err)
+		problem.Error(w, r, http.StatusUnauthorized, "Invalid acct or password")
+		a.publish(model.TopicLoginFailed, acct, err.Error())
+		if a.lockout.Fail(acct) {
+			a.publish(model.TopicUserLocked, acct, "Too many failed logins")
+		}
 		return
 	}
-
-	token, err := a.UserRepo.Validate(acct, pwd)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		go func() {
-			router.LoginFailuresCh <- err.Error()
-		}()
+		problem.Internal(w, r, err)
 		return
 	}
 
+	a.lockout.Succeed(acct)
+	a.publish(model.TopicLoginSucceeded, acct, "")
+
 	w.Header().Set("Content-Type", "application/json")
 	if err = json.NewEncoder(w).Encode(&token); err != nil {
-		http.Error(w, "Error encoding response object", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 	}
 }
 
-// Helper function to check and parse query string for sorting field and order direction
-func (a *APIv1) validateSortQuery(sortBy string) (string, error) {
+// Helper function to check and parse query string for sorting fields and order directions.
+// Acct ends the keys, so the order is unique and cursors point between two users.
+func (a *APIv1) validateSortQuery(sortBy string) ([]pagination.Key, error) {
+	return pagination.ParseSort(sortBy, sortableFields(), "acct")
+}
 
-	splits := strings.Split(sortBy, ".")
-	if len(splits) != 2 {
-		return "", errors.New("unknown sortBy parameter, should be field.orderdirection")
+// ListAllUsers sends one page of users with cursors of the next and previous pages,
+// optionally filtered, sorted and with total count of matching users
+func (a *APIv1) ListAllUsers(w http.ResponseWriter, r *http.Request) {
+	sortBy := "acct.asc" // default ordering is ascending with acct field
+	if sortByQuery := r.URL.Query().Get("sortBy"); sortByQuery != "" {
+		sortBy = sortByQuery
 	}
 
-	field, order := splits[0], splits[1]
-	if order != "desc" && order != "asc" {
-		return "", errors.New("unknown ordering in sortBy parameter, should be asc or desc")
+	q, sortBy, ok := readPageParams(w, r, sortBy)
+	if !ok {
+		return
 	}
 
-	return fmt.Sprintf("%s %s", field, strings.ToUpper(order)), nil
-}
+	var err error
+	q.Sort, err = a.validateSortQuery(sortBy)
+	if err != nil {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "sortBy", Reason: "SortBy parameter is invalid: " + err.Error()})
+		return
+	}
 
-// ListAllUsers sends all users with option to have result sorted and paginated
-func (a *APIv1) ListAllUsers(w http.ResponseWriter, r *http.Request) {
-	var (
-		limit     = -1         // default limit is unlimited
-		offset    = -1         // default offset is no offset
-		sortQuery = "acct ASC" // default ordering is ascending with acct field
-		err       error
-	)
-
-	sortByQuery := r.URL.Query().Get("sortBy")
-	if sortByQuery != "" {
-		sortQuery, err = a.validateSortQuery(sortByQuery)
-		if err != nil {
-			http.Error(w, "SortBy parameter is invalid: "+err.Error(), http.StatusBadRequest)
-			return
-		}
+	page, err := a.UserRepo.FindPage(q)
+	if errors.Is(err, pagination.ErrInvalidCursor) {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "cursor", Reason: "Cursor is invalid or does not match sortBy"})
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
 	}
 
-	limitQuery := r.URL.Query().Get("limit")
-	if limitQuery != "" {
-		limit, err = strconv.Atoi(limitQuery)
-		if err != nil || limit < -1 {
-			http.Error(w, "limit parameter is invalid number", http.StatusBadRequest)
-			return
-		}
+	resp := newUserPage(page, q, sortBy)
+	writePageLinks(w, r, resp.Next, resp.Prev)
+
+	w.Header().Add("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		problem.Internal(w, r, err)
+	}
+}
+
+// SearchUsers sends one page of users whose acct or fullname resembles q parameter, best matches
+// first. Matching ignores case and accents and tolerates typos, results may be filtered and counted.
+func (a *APIv1) SearchUsers(w http.ResponseWriter, r *http.Request) {
+	text := validation.Normalize(r.URL.Query().Get("q"))
+	if n := utf8.RuneCountInString(text); n == 0 || n > 100 {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "q", Reason: "Search text must have 1 to 100 characters"})
+		return
 	}
 
-	offsetQuery := r.URL.Query().Get("offset")
-	if offsetQuery != "" {
-		offset, err = strconv.Atoi(offsetQuery)
-		if err != nil || offset < -1 {
-			http.Error(w, "offset parameter is invalid number", http.StatusBadRequest)
-			return
-		}
+	q, sortBy, ok := readPageParams(w, r, sortByRelevance)
+	if !ok {
+		return
+	}
+	if sortBy != sortByRelevance {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "cursor", Reason: "Cursor is not one of search results"})
+		return
 	}
+	q.Sort = []pagination.Key{{Column: "rank", Desc: true}, {Column: "acct"}}
 
-	users, err := a.UserRepo.Find("", "", sortQuery, limit, offset, true)
+	page, err := a.UserRepo.Search(text, q)
+	if errors.Is(err, pagination.ErrInvalidCursor) {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "cursor", Reason: "Cursor is not one of search results"})
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error to find all users"+err.Error(), http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 		return
 	}
 
+	resp := newUserSearchPage(page, q)
+	writePageLinks(w, r, resp.Next, resp.Prev)
+
 	w.Header().Add("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(users); err != nil {
-		http.Error(w, "Error encoding response object", http.StatusInternalServerError)
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		problem.Internal(w, r, err)
 	}
 }
 
@@ -207,138 +229,173 @@ func (a *APIv1) SearchUserbyFullname(w http.ResponseWriter, r *http.Request) {
 	fullname, ok := urlParams["fullname"]
 
 	if !ok {
-		http.Error(w, "Unknown error", http.StatusUnprocessableEntity)
+		problem.Error(w, r, http.StatusUnprocessableEntity, "Unknown error")
 		return
 	}
 
 	// Validate fullname
-	reFullname := regexp.MustCompile("^([A-Z][a-z]{0,40}\\s{1,10}[A-Z][a-z]{0,49})$")
-	if !reFullname.MatchString(fullname) {
-		http.Error(w, "Fullname does not follow pattern: \"Jacky Yang\"", http.StatusBadRequest)
+	fullname, err := a.rules.Fullname(fullname)
+	if err != nil {
+		problem.Invalid(w, r, appendInvalid(nil, err)...)
 		return
 	}
 
 	users, err := a.UserRepo.Find("", fullname, "", 0, 0, true)
 	if err != nil {
-		http.Error(w, "DB query error to find all users with fullname: "+err.Error(), http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(users); err != nil {
-		http.Error(w, "Error encoding response object", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 	}
 }
 
-// GetUserDetail sends for acct all database fields except password
+// GetUserDetail sends for acct all database fields except password, with ETag of its version
 func (a *APIv1) GetUserDetail(w http.ResponseWriter, r *http.Request) {
 	urlParams := mux.Vars(r)
 	acct, ok := urlParams["acct"]
 
 	if !ok {
-		http.Error(w, "Unknown error", http.StatusUnprocessableEntity)
+		problem.Error(w, r, http.StatusUnprocessableEntity, "Unknown error")
 		return
 	}
 
 	// Validate acct(username)
-	reAcct := regexp.MustCompile("^([a-z_][a-z0-9_]{3,30})$")
-	if !reAcct.MatchString(acct) {
-		http.Error(w, "Acct is not valid username", http.StatusBadRequest)
+	acct, err := a.rules.Acct(acct)
+	if err != nil {
+		problem.Invalid(w, r, appendInvalid(nil, err)...)
 		return
 	}
 
 	users, err := a.UserRepo.Find(acct, "", "", 0, 0, false)
 	if err != nil {
-		http.Error(w, "DB query error to find user: "+err.Error(), http.StatusInternalServerError)
+		problem.Internal(w, r, err)
+		return
+	}
+	if len(users) == 0 {
+		repositoryError(w, r, repository.ErrNotFound, "User")
+		return
+	}
+
+	// Version is the entity tag, clients send it back to change the user or to skip unchanged one
+	tag := etag(userVersion(users[0]))
+	w.Header().Set("ETag", tag)
+	if notModified(r, tag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(users); err != nil {
-		http.Error(w, "Error encoding response object", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 	}
 }
 
-// UpdateUser updates user with new password or fullname
+// UpdateUser updates user with new password or fullname, only its version from If-Match when given
 func (a *APIv1) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	urlParams := mux.Vars(r)
 	acct, ok := urlParams["acct"]
-	fullname := r.FormValue("fullname")
-	pwd := r.FormValue("pwd")
 
 	if !ok {
-		http.Error(w, "Unknown error", http.StatusUnprocessableEntity)
+		problem.Error(w, r, http.StatusUnprocessableEntity, "Unknown error")
 		return
 	}
 
+	var in updateInput
+	if !readInput(w, r, &in) {
+		return
+	}
+	fullname, pwd := in.Fullname, in.Pwd
+
 	// Validate acct(username)
-	reAcct := regexp.MustCompile("^([a-z_][a-z0-9_]{3,30})$")
-	if !reAcct.MatchString(acct) {
-		http.Error(w, "Acct is not valid username", http.StatusBadRequest)
+	acct, err := a.rules.Acct(acct)
+	if err != nil {
+		problem.Invalid(w, r, appendInvalid(nil, err)...)
 		return
 	}
 
 	// Check if anything to change
 	if fullname == "" && pwd == "" {
-		http.Error(w, "Nothing to change", http.StatusBadRequest)
+		problem.Error(w, r, http.StatusBadRequest, "Nothing to change")
 		return
 	}
 
-	// Validate fullname
-	reFullname := regexp.MustCompile("^([A-Z][a-z]{0,40}\\s{1,10}[A-Z][a-z]{0,49})$")
-	if fullname != "" && !reFullname.MatchString(fullname) {
-		http.Error(w, "Fullname does not follow pattern: \"Jacky Yang\"", http.StatusBadRequest)
+	// Validate fullname and password which are changed
+	var invalid []problem.InvalidParam
+	if fullname != "" {
+		fullname, err = a.rules.Fullname(fullname)
+		invalid = appendInvalid(invalid, err)
+	}
+	if pwd != "" {
+		pwd, err = a.rules.Pwd(pwd)
+		invalid = appendInvalid(invalid, err)
+	}
+
+	if len(invalid) > 0 {
+		problem.Invalid(w, r, invalid...)
 		return
 	}
 
-	// Validate password for length
-	if pwd != "" && len(pwd) < 8 {
-		http.Error(w, "Password length is less than 8 characters", http.StatusBadRequest)
+	// Change based on stale version is refused with If-Match
+	versions := ifMatchVersions(r)
+	if versions != nil && len(versions) == 0 {
+		repositoryError(w, r, repository.ErrPreconditionFailed, "User")
 		return
 	}
 
-	if err := a.UserRepo.Update(acct, fullname, pwd); err != nil {
-		http.Error(w, "Error updating user in database: "+err.Error(), http.StatusInternalServerError)
+	version, err := a.UserRepo.Update(acct, fullname, pwd, versions)
+	if err != nil {
+		repositoryError(w, r, err, "User")
 		return
 	}
 
+	w.Header().Set("ETag", etag(version))
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode("User updated successfully"); err != nil {
-		http.Error(w, "Error encoding response object", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 	}
 }
 
-// DeleteUser removes user from database
+// DeleteUser removes user from database, only its version from If-Match when given
 func (a *APIv1) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	urlParams := mux.Vars(r)
 	claimedAcct := r.Header.Get("acct")
 	acct, ok := urlParams["acct"]
 
-	// Compare user performing delete with the user to be deleted
-	if claimedAcct == acct {
-		http.Error(w, "User cannot delete herself", http.StatusUnprocessableEntity)
+	if !ok {
+		problem.Error(w, r, http.StatusUnprocessableEntity, "Unknown error")
 		return
 	}
 
-	if !ok {
-		http.Error(w, "Unknown error", http.StatusUnprocessableEntity)
+	// Validate acct(username)
+	acct, err := a.rules.Acct(acct)
+	if err != nil {
+		problem.Invalid(w, r, appendInvalid(nil, err)...)
 		return
 	}
 
-	// Validate acct(username)
-	reAcct := regexp.MustCompile("^([a-z_][a-z0-9_]{3,30})$")
-	if !reAcct.MatchString(acct) {
-		http.Error(w, "Acct is not valid username", http.StatusBadRequest)
+	// Compare user performing delete with the user to be deleted
+	if claimedAcct == acct {
+		problem.Error(w, r, http.StatusUnprocessableEntity, "User cannot delete herself")
+		return
+	}
+
+	// Deletion based on stale version is refused with If-Match
+	versions := ifMatchVersions(r)
+	if versions != nil && len(versions) == 0 {
+		repositoryError(w, r, repository.ErrPreconditionFailed, "User")
 		return
 	}
 
-	if err := a.UserRepo.Delete(acct); err != nil {
-		http.Error(w, "Error deleting user from database: "+err.Error(), http.StatusInternalServerError)
+	if err = a.UserRepo.Delete(acct, versions); err != nil {
+		repositoryError(w, r, err, "User")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode("User deleted successfully"); err != nil {
-		http.Error(w, "Error encoding response object", http.StatusInternalServerError)
+		problem.Internal(w, r, err)
 	}
 }
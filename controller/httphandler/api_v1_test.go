@@ -0,0 +1,308 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/pagination"
+	"github.com/romanzac/gorilla-feast/infra/ssha"
+	"github.com/romanzac/gorilla-feast/infra/validation"
+	"github.com/romanzac/gorilla-feast/middleware"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubUserRepo answers the user operations a test needs, others panic
+type stubUserRepo struct {
+	repository.UserRepository
+	search   func(text string, q repository.UserPageQuery) (repository.UserSearchPage, error)
+	validate func(acct, pwd, rawPwd string) (middleware.JWTToken, error)
+	users    map[string]model.User
+	update   func(acct string, versions []repository.UserVersion) (repository.UserVersion, error)
+	delete   func(acct string, versions []repository.UserVersion) error
+}
+
+func (s *stubUserRepo) Find(acct, fullname, sortQuery string, limit, offset int, noDetail bool) ([]model.User, error) {
+	if u, ok := s.users[acct]; ok {
+		return []model.User{u}, nil
+	}
+	return nil, nil
+}
+func (s *stubUserRepo) Update(acct, fullname, pwd string, versions []repository.UserVersion) (repository.UserVersion, error) {
+	return s.update(acct, versions)
+}
+func (s *stubUserRepo) Delete(acct string, versions []repository.UserVersion) error {
+	return s.delete(acct, versions)
+}
+
+func (s *stubUserRepo) Search(text string, q repository.UserPageQuery) (repository.UserSearchPage, error) {
+	return s.search(text, q)
+}
+func (s *stubUserRepo) Validate(acct, pwd, rawPwd string) (middleware.JWTToken, error) {
+	return s.validate(acct, pwd, rawPwd)
+}
+func (s *stubUserRepo) AddEvent(topic, acct, detail string) error { return nil }
+
+func TestSearchUsers(t *testing.T) {
+	config.Cfg.Web.PageSize, config.Cfg.Web.MaxPageSize = 2, 10
+
+	var searched []string
+	var queries []repository.UserPageQuery
+	repo := &stubUserRepo{search: func(text string, q repository.UserPageQuery) (repository.UserSearchPage, error) {
+		searched, queries = append(searched, text), append(queries, q)
+		if len(q.After) > 0 && q.After[0] == "not a rank" {
+			return repository.UserSearchPage{}, pagination.ErrInvalidCursor
+		}
+		return repository.UserSearchPage{More: true, Total: -1, Matches: []model.UserMatch{
+			{Acct: "jacky_yang", Fullname: "Jacky Yang", Rank: float64(float32(0.8333333))},
+			{Acct: "jacky_yeung", Fullname: "Jacky Yeung", Rank: float64(float32(0.5714286))},
+		}}, nil
+	}}
+	a := &APIv1{UserRepo: repo}
+
+	search := func(query url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.SearchUsers(w, httptest.NewRequest("GET", "/api/v1/user/search?"+query.Encode(), nil))
+		return w
+	}
+	relevance := func(values ...string) string {
+		return pagination.Cursor{Sort: sortByRelevance, Values: values}.Encode()
+	}
+
+	// Search text is normalized and must have 1 to 100 characters
+	invalid := []struct {
+		name  string
+		query url.Values
+		param string
+	}{
+		{"missing q", url.Values{}, `"q"`},
+		{"spaces only", url.Values{"q": {" \t "}}, `"q"`},
+		{"too long q", url.Values{"q": {strings.Repeat("ą", 101)}}, `"q"`},
+		{"foreign cursor", url.Values{"q": {"jacky"},
+			"cursor": {pagination.Cursor{Sort: "acct.asc", Values: []string{"jacky_yang"}}.Encode()}}, `"cursor"`},
+		{"forged cursor", url.Values{"q": {"jacky"}, "cursor": {"eyJzIjoicmVsZXZhbmNlIn0x"}}, `"cursor"`},
+		{"cursor rejected by repository", url.Values{"q": {"jacky"},
+			"cursor": {relevance("not a rank", "jacky_yang")}}, `"cursor"`},
+		{"invalid limit", url.Values{"q": {"jacky"}, "limit": {"0"}}, `"limit"`},
+	}
+	for _, tt := range invalid {
+		w := search(tt.query)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.param) {
+			t.Errorf("%s: %d %s", tt.name, w.Code, w.Body.String())
+		}
+	}
+	if len(searched) != 1 {
+		t.Fatalf("Invalid searches reached the repository %d times, want once for the rejected cursor",
+			len(searched))
+	}
+
+	// Text of 100 characters is searched normalized, best matches first with cursor after the last
+	searched, queries = nil, nil
+	w := search(url.Values{"q": {"  Jacky   " + strings.Repeat("ą", 94)}})
+	if w.Code != http.StatusOK || len(searched) != 1 || searched[0] != "Jacky "+strings.Repeat("ą", 94) {
+		t.Fatalf("Search: %d %s, searched %q", w.Code, w.Body.String(), searched)
+	}
+	q := queries[0]
+	if q.Limit != 2 || len(q.Sort) != 2 || q.Sort[0] != (pagination.Key{Column: "rank", Desc: true}) ||
+		q.Sort[1] != (pagination.Key{Column: "acct"}) {
+		t.Errorf("Search query is wrong: %+v", q)
+	}
+
+	var resp userSearchPage
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Decoding response: %s", err)
+	}
+	if len(resp.Users) != 2 || resp.Users[0].Acct != "jacky_yang" || resp.Prev != "" || resp.Total != nil {
+		t.Errorf("Response is wrong: %+v", resp)
+	}
+	if resp.Next != relevance("0.5714286", "jacky_yeung") {
+		t.Errorf("Next cursor is wrong: %s", resp.Next)
+	}
+	if link := w.Header().Get("Link"); !strings.Contains(link, `rel="next"`) {
+		t.Errorf("Link header is wrong: %q", link)
+	}
+
+	// Next page continues after the cursor
+	searched, queries = nil, nil
+	if w = search(url.Values{"q": {"jacky"}, "cursor": {resp.Next}}); w.Code != http.StatusOK {
+		t.Fatalf("Next page: %d %s", w.Code, w.Body.String())
+	}
+	if after := queries[0].After; len(after) != 2 || after[0] != "0.5714286" || after[1] != "jacky_yeung" ||
+		queries[0].Before {
+		t.Errorf("Next page query is wrong: %+v", queries[0])
+	}
+}
+
+func TestLoginNormalizesPwd(t *testing.T) {
+	config.Cfg.Web.MaxBodySize = 1024
+	rules, err := validation.New("", "", nil)
+	if err != nil {
+		t.Fatalf("Rules: %s", err)
+	}
+
+	// Decomposed é is checked as composed, the password as sent is passed for older hashes
+	var got []string
+	repo := &stubUserRepo{validate: func(acct, pwd, rawPwd string) (middleware.JWTToken, error) {
+		got = []string{acct, pwd, rawPwd}
+		return middleware.JWTToken{}, nil
+	}}
+	a := &APIv1{UserRepo: repo, rules: rules, lockout: newLoginLockout(0, 0, 0)}
+
+	r := httptest.NewRequest("POST", "/api/v1/login",
+		strings.NewReader(`{"acct":"jacky_yang","pwd":"cafe\u0301 secret"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	a.Login(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login: %d %s", w.Code, w.Body.String())
+	}
+	if len(got) != 3 || got[1] != "caf\u00e9 secret" || got[2] != "cafe\u0301 secret" {
+		t.Errorf("Validated %q", got)
+	}
+}
+
+func TestLoginShortMultibytePwd(t *testing.T) {
+	config.Cfg.Web.MaxBodySize = 1024
+	rules, err := validation.New("", "", nil)
+	if err != nil {
+		t.Fatalf("Rules: %s", err)
+	}
+
+	// Four characters of three bytes each were long enough when bytes were counted
+	hash, err := ssha.GeneratePassword("密碼密碼", 8)
+	if err != nil {
+		t.Fatalf("Hashing password: %s", err)
+	}
+	repo := &stubUserRepo{validate: func(acct, pwd, rawPwd string) (middleware.JWTToken, error) {
+		if ok, _ := ssha.ValidatePassword(pwd, hash); !ok {
+			return middleware.JWTToken{}, &repository.CredentialsError{Acct: acct, Reason: "Password incorrect"}
+		}
+		return middleware.JWTToken{}, nil
+	}}
+	a := &APIv1{UserRepo: repo, rules: rules, lockout: newLoginLockout(0, 0, 0)}
+
+	for pwd, want := range map[string]int{"密碼密碼": http.StatusOK, "密碼": http.StatusUnauthorized,
+		"": http.StatusBadRequest} {
+		r := httptest.NewRequest("POST", "/api/v1/login",
+			strings.NewReader(`{"acct":"jacky_yang","pwd":"`+pwd+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		a.Login(w, r)
+		if w.Code != want {
+			t.Errorf("Login with %q: %d %s, want %d", pwd, w.Code, w.Body.String(), want)
+		}
+	}
+}
+
+func TestUserPreconditions(t *testing.T) {
+	config.Cfg.Web.MaxBodySize = 1024
+	rules, err := validation.New("", "", nil)
+	if err != nil {
+		t.Fatalf("Rules: %s", err)
+	}
+
+	created := time.Date(2024, 1, 1, 12, 0, 0, 123456000, time.UTC)
+	current := repository.UserVersion{CreatedAt: created, Version: 3}
+	tag, stale := etag(current), etag(repository.UserVersion{CreatedAt: created, Version: 2})
+
+	// Repository changes users of the current version only, like the database
+	var calls int
+	change := func(acct string, versions []repository.UserVersion) error {
+		calls++
+		if acct != "jacky_yang" {
+			return repository.ErrNotFound
+		}
+		if versions == nil {
+			return nil
+		}
+		for _, v := range versions {
+			if v.CreatedAt.Equal(current.CreatedAt) && v.Version == current.Version {
+				return nil
+			}
+		}
+		return repository.ErrPreconditionFailed
+	}
+	repo := &stubUserRepo{
+		users: map[string]model.User{"jacky_yang": {Acct: "jacky_yang", CreatedAt: &created, Version: 3}},
+		update: func(acct string, versions []repository.UserVersion) (repository.UserVersion, error) {
+			if err := change(acct, versions); err != nil {
+				return repository.UserVersion{}, err
+			}
+			return repository.UserVersion{CreatedAt: created, Version: 4}, nil
+		},
+		delete: change,
+	}
+	a := &APIv1{UserRepo: repo, rules: rules}
+
+	send := func(method, acct, header, value string) *httptest.ResponseRecorder {
+		var r *http.Request
+		switch method {
+		case "GET":
+			r = httptest.NewRequest(method, "/api/v1/user/"+acct+"/detail", nil)
+		case "PATCH":
+			r = httptest.NewRequest(method, "/api/v1/user/"+acct, strings.NewReader(`{"fullname":"Jacky Yang"}`))
+			r.Header.Set("Content-Type", "application/json")
+		default:
+			r = httptest.NewRequest(method, "/api/v1/user/"+acct, nil)
+		}
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		r = mux.SetURLVars(r, map[string]string{"acct": acct})
+		w := httptest.NewRecorder()
+		switch method {
+		case "GET":
+			a.GetUserDetail(w, r)
+		case "PATCH":
+			a.UpdateUser(w, r)
+		default:
+			a.DeleteUser(w, r)
+		}
+		return w
+	}
+
+	tests := []struct {
+		name          string
+		method, acct  string
+		header, value string
+		status        int
+		etag          string
+	}{
+		{"detail", "GET", "jacky_yang", "", "", http.StatusOK, tag},
+		{"unchanged detail", "GET", "jacky_yang", "If-None-Match", tag, http.StatusNotModified, tag},
+		{"unchanged detail weak", "GET", "jacky_yang", "If-None-Match", "W/" + tag, http.StatusNotModified, tag},
+		{"changed detail", "GET", "jacky_yang", "If-None-Match", stale, http.StatusOK, tag},
+		{"missing detail", "GET", "mary_jane", "If-None-Match", "*", http.StatusNotFound, ""},
+		{"update", "PATCH", "jacky_yang", "If-Match", tag, http.StatusOK,
+			etag(repository.UserVersion{CreatedAt: created, Version: 4})},
+		{"stale update", "PATCH", "jacky_yang", "If-Match", stale, http.StatusPreconditionFailed, ""},
+		{"update with foreign tag", "PATCH", "jacky_yang", "If-Match", `"3"`, http.StatusPreconditionFailed, ""},
+		{"update of missing user", "PATCH", "mary_jane", "If-Match", tag, http.StatusNotFound, ""},
+		{"unconditional update of missing user", "PATCH", "mary_jane", "", "", http.StatusNotFound, ""},
+		{"stale delete", "DELETE", "jacky_yang", "If-Match", stale, http.StatusPreconditionFailed, ""},
+		{"delete with weak tag", "DELETE", "jacky_yang", "If-Match", "W/" + tag, http.StatusPreconditionFailed, ""},
+		{"delete of missing user", "DELETE", "mary_jane", "If-Match", "*", http.StatusNotFound, ""},
+		{"delete", "DELETE", "jacky_yang", "If-Match", tag, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := send(tt.method, tt.acct, tt.header, tt.value)
+		if w.Code != tt.status || w.Header().Get("ETag") != tt.etag {
+			t.Errorf("%s: %d with ETag %q, want %d with %q: %s", tt.name, w.Code, w.Header().Get("ETag"),
+				tt.status, tt.etag, w.Body.String())
+		}
+		if tt.status == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s: body sent with 304", tt.name)
+		}
+	}
+
+	// Changes with none of our tags are refused before reaching the repository
+	if calls != 7 {
+		t.Errorf("Repository was called %d times, want 7", calls)
+	}
+}
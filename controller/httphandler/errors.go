@@ -0,0 +1,37 @@
+package httphandler
+
+import (
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"github.com/romanzac/gorilla-feast/infra/validation"
+	"net/http"
+)
+
+// repositoryError answers client with status of domain error about subject like "User",
+// other errors are internal
+func repositoryError(w http.ResponseWriter, r *http.Request, err error, subject string) {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		problem.Error(w, r, http.StatusNotFound, subject+" not found")
+	case errors.Is(err, repository.ErrAlreadyExists):
+		problem.Error(w, r, http.StatusConflict, subject+" already exists")
+	case errors.Is(err, repository.ErrPreconditionFailed):
+		problem.Error(w, r, http.StatusPreconditionFailed, subject+" was changed since it was read, read it again")
+	case errors.Is(err, repository.ErrConflict):
+		problem.Error(w, r, http.StatusConflict, subject+" was changed at the same time, try again")
+	case errors.Is(err, repository.ErrInvalidCredentials):
+		problem.Error(w, r, http.StatusUnauthorized, "Invalid acct or password")
+	default:
+		problem.Internal(w, r, err)
+	}
+}
+
+// appendInvalid adds field of validation error to invalid params, other errors add nothing
+func appendInvalid(invalid []problem.InvalidParam, err error) []problem.InvalidParam {
+	var verr *validation.Error
+	if errors.As(err, &verr) {
+		invalid = append(invalid, problem.InvalidParam{Name: verr.Field, Reason: verr.Reason})
+	}
+	return invalid
+}
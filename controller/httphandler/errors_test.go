@@ -0,0 +1,38 @@
+package httphandler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRepositoryError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		detail string
+	}{
+		{repository.ErrNotFound, http.StatusNotFound, "User not found"},
+		{repository.ErrAlreadyExists, http.StatusConflict, "User already exists"},
+		{repository.ErrPreconditionFailed, http.StatusPreconditionFailed, "User was changed since it was read"},
+		{fmt.Errorf("%w: deadlock detected", repository.ErrConflict), http.StatusConflict,
+			"User was changed at the same time"},
+		{&repository.CredentialsError{Acct: "jacky_yang", Reason: "wrong password"}, http.StatusUnauthorized,
+			"Invalid acct or password"},
+		{errors.New("connection refused"), http.StatusInternalServerError, "error_id"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		repositoryError(w, httptest.NewRequest("GET", "/api/v1/user/jacky_yang", nil), tt.err, "User")
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.detail) {
+			t.Errorf("%v: %d %s, want %d with %q", tt.err, w.Code, w.Body.String(), tt.status, tt.detail)
+		}
+		if strings.Contains(w.Body.String(), "deadlock") || strings.Contains(w.Body.String(), "connection refused") {
+			t.Errorf("%v: details leaked to client: %s", tt.err, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package httphandler
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etag returns entity tag of user version. It carries the creation time in microseconds,
+// so a tag of a deleted user does not match the user signed up again with the same acct.
+func etag(v repository.UserVersion) string {
+	return `"` + strconv.FormatInt(v.CreatedAt.UnixMicro(), 10) + "-" + strconv.FormatInt(v.Version, 10) + `"`
+}
+
+// parseETag reads user version of strong entity tag, false for weak, foreign or malformed tags
+func parseETag(tag string) (repository.UserVersion, bool) {
+	if len(tag) < 2 || !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) {
+		return repository.UserVersion{}, false
+	}
+	created, version, found := strings.Cut(tag[1:len(tag)-1], "-")
+	if !found {
+		return repository.UserVersion{}, false
+	}
+	micros, err := strconv.ParseInt(created, 10, 64)
+	if err != nil {
+		return repository.UserVersion{}, false
+	}
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || v < 1 {
+		return repository.UserVersion{}, false
+	}
+	return repository.UserVersion{CreatedAt: time.UnixMicro(micros), Version: v}, true
+}
+
+// userVersion returns version of user read with its creation time
+func userVersion(u model.User) repository.UserVersion {
+	v := repository.UserVersion{Version: u.Version}
+	if u.CreatedAt != nil {
+		v.CreatedAt = *u.CreatedAt
+	}
+	return v
+}
+
+// etagList splits If-Match or If-None-Match header into tags, nil when it is missing
+func etagList(r *http.Request, header string) []string {
+	var tags []string
+	for _, value := range r.Header.Values(header) {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// ifMatchVersions reads versions of If-Match header. It returns nil when any version may be
+// changed, because the header is missing or *. Weak and foreign tags never match, so a header
+// with none of our tags returns empty versions and the change must fail.
+func ifMatchVersions(r *http.Request) []repository.UserVersion {
+	tags := etagList(r, "If-Match")
+	if tags == nil {
+		return nil
+	}
+
+	versions := []repository.UserVersion{}
+	for _, tag := range tags {
+		if tag == "*" {
+			return nil
+		}
+		if v, ok := parseETag(tag); ok {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// notModified reports whether If-None-Match header lists current tag, weak tags match too
+func notModified(r *http.Request, current string) bool {
+	for _, tag := range etagList(r, "If-None-Match") {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == current {
+			return true
+		}
+	}
+	return false
+}
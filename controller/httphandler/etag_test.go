@@ -0,0 +1,99 @@
+package httphandler
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestETag(t *testing.T) {
+	created := time.Date(2024, 1, 1, 12, 0, 0, 123456000, time.UTC)
+	v := repository.UserVersion{CreatedAt: created, Version: 3}
+	tag := etag(v)
+	if tag != `"1704110400123456-3"` {
+		t.Errorf("Tag is %s", tag)
+	}
+	if parsed, ok := parseETag(tag); !ok || !parsed.CreatedAt.Equal(created) || parsed.Version != 3 {
+		t.Errorf("Tag %s reads back as %+v, %v", tag, parsed, ok)
+	}
+
+	// The same version of a user signed up again has another tag
+	if again := etag(repository.UserVersion{CreatedAt: created.Add(time.Microsecond), Version: 3}); again == tag {
+		t.Errorf("Tag %s does not tell users of the same acct apart", again)
+	}
+}
+
+func TestIfMatchVersions(t *testing.T) {
+	created := time.Date(2024, 1, 1, 12, 0, 0, 123456000, time.UTC)
+	v := func(version int64) repository.UserVersion {
+		return repository.UserVersion{CreatedAt: created, Version: version}
+	}
+
+	tests := []struct {
+		name   string
+		header []string
+		want   []repository.UserVersion
+	}{
+		{"missing", nil, nil},
+		{"any", []string{"*"}, nil},
+		{"any in list", []string{`"1704110400123456-3", *`}, nil},
+		{"one", []string{`"1704110400123456-3"`}, []repository.UserVersion{v(3)}},
+		{"list", []string{` "1704110400123456-3" ,"1704110400123456-4"`}, []repository.UserVersion{v(3), v(4)}},
+		{"repeated header", []string{`"1704110400123456-3"`, `"1704110400123456-4"`},
+			[]repository.UserVersion{v(3), v(4)}},
+		{"weak", []string{`W/"1704110400123456-3"`}, []repository.UserVersion{}},
+		{"weak in list", []string{`W/"1704110400123456-3", "1704110400123456-4"`}, []repository.UserVersion{v(4)}},
+		{"version only", []string{`"3"`}, []repository.UserVersion{}},
+		{"unquoted", []string{`1704110400123456-3`}, []repository.UserVersion{}},
+		{"quote only", []string{`"`}, []repository.UserVersion{}},
+		{"not numbers", []string{`"abc-def"`, `"1704110400123456-x"`}, []repository.UserVersion{}},
+		{"zero version", []string{`"1704110400123456-0"`}, []repository.UserVersion{}},
+		{"empty values", []string{` , `}, nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PATCH", "/api/v1/user/jacky_yang", nil)
+		for _, value := range tt.header {
+			r.Header.Add("If-Match", value)
+		}
+		got := ifMatchVersions(r)
+		if (got == nil) != (tt.want == nil) || len(got) != len(tt.want) {
+			t.Errorf("%s: versions %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].CreatedAt.Equal(tt.want[i].CreatedAt) || got[i].Version != tt.want[i].Version {
+				t.Errorf("%s: versions %+v, want %+v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	current := `"1704110400123456-3"`
+	tests := []struct {
+		name   string
+		header []string
+		want   bool
+	}{
+		{"missing", nil, false},
+		{"any", []string{"*"}, true},
+		{"current", []string{current}, true},
+		{"weak current", []string{`W/` + current}, true},
+		{"list", []string{`"1704110400123456-2", ` + current}, true},
+		{"repeated header", []string{`"1704110400123456-2"`, current}, true},
+		{"stale", []string{`"1704110400123456-2"`}, false},
+		{"other user of the acct", []string{`"1704110400123457-3"`}, false},
+		{"unquoted", []string{`1704110400123456-3`}, false},
+		{"malformed", []string{`W/`, `"`}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/user/jacky_yang/detail", nil)
+		for _, value := range tt.header {
+			r.Header.Add("If-None-Match", value)
+		}
+		if got := notModified(r, current); got != tt.want {
+			t.Errorf("%s: not modified %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
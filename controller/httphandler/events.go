@@ -0,0 +1,272 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"github.com/romanzac/gorilla-feast/infra/eventcodec"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"github.com/romanzac/gorilla-feast/infra/router"
+	"github.com/romanzac/gorilla-feast/middleware"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LoginFailures reports user login failures to websocket client.
+// Optional since parameter replays failures after the event with that ID.
+func (a *APIv1) LoginFailures(w http.ResponseWriter, r *http.Request) {
+	a.serveEvents(w, r, eventbus.Filter{Topics: []string{model.TopicLoginFailed}})
+}
+
+// UserEvents reports user and login events to websocket client, filtered by topic and acct query parameters.
+// Optional since parameter replays events after the event with that ID.
+func (a *APIv1) UserEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := eventbus.ParseFilter(r.URL.Query().Get("topic"), r.URL.Query().Get("acct"))
+	if err != nil {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "acct", Reason: "Event filter is invalid: " + err.Error()})
+		return
+	}
+
+	a.serveEvents(w, r, filter)
+}
+
+// serveEvents upgrades connection to websocket and writes events matching the filter
+// in encoding negotiated through subprotocol, JSON by default
+func (a *APIv1) serveEvents(w http.ResponseWriter, r *http.Request, filter eventbus.Filter) {
+	var since uint64
+
+	sinceQuery := r.URL.Query().Get("since")
+	if sinceQuery != "" {
+		var err error
+		since, err = strconv.ParseUint(sinceQuery, 10, 64)
+		if err != nil {
+			problem.Invalid(w, r, problem.InvalidParam{Name: "since", Reason: "since parameter is invalid event ID"})
+			return
+		}
+	}
+
+	// Subscribe before upgrade, so the client gets error status if missed events cannot be found
+	sub, missed, err := a.subscribe(filter, since, sinceQuery != "")
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	defer a.Events.Unsubscribe(sub)
+
+	// Confirm the chosen encoding or the subprotocol which carried the token, browsers insist on one of them
+	var responseHeader http.Header
+	encoding := eventcodec.Negotiate(websocket.Subprotocols(r))
+	if encoding != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {encoding}}
+	} else if p := middleware.TokenSubprotocol(r); p != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {p}}
+	}
+
+	// Upgrade connection to websocket
+	c, err := router.Upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		log.Print("Upgrade to websocket connection has failed:", err)
+		return
+	}
+
+	defer func(c *websocket.Conn) {
+		if err := c.Close(); err != nil {
+			log.Println("Error closing websocket connection:", err)
+		}
+	}(c)
+
+	// Client sends nothing but control frames, pongs and any message keep the connection alive
+	cfg := config.Cfg.Web
+	c.SetReadLimit(cfg.WSMaxMessageSize)
+	_ = c.SetReadDeadline(time.Now().Add(cfg.WSPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(cfg.WSPongWait))
+	})
+
+	// Read until the client closes the connection or stops answering pings
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Println("Websocket client has gone:", err)
+				}
+				return
+			}
+			_ = c.SetReadDeadline(time.Now().Add(cfg.WSPongWait))
+		}
+	}()
+
+	// Send missed events first
+	for _, e := range missed {
+		if err = writeWebsocketEvent(c, encoding, e); err != nil {
+			log.Println("Write to websocket failed:", err)
+			return
+		}
+	}
+
+	ping := time.NewTicker(cfg.WSPingInterval)
+	defer ping.Stop()
+
+	// Wait and send live events to the client
+	for {
+		select {
+		case e, ok := <-sub.Messages():
+			if !ok {
+				// Channel closed by the bus, client was too slow to keep up
+				log.Println("Disconnecting slow websocket client:", c.RemoteAddr())
+				closeWebsocket(c, gone, websocket.CloseTryAgainLater, "too slow to keep up")
+				return
+			}
+			err = writeWebsocketEvent(c, encoding, e)
+		case <-ping.C:
+			err = c.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.WSWriteWait))
+		case <-gone:
+			// Close frame from the client was answered by the default close handler
+			return
+		}
+		if err != nil {
+			log.Println("Write to websocket failed:", err)
+			return
+		}
+	}
+}
+
+// subscribe registers subscription for events matching the filter,
+// missed events after since are replayed only when the client resumes
+func (a *APIv1) subscribe(filter eventbus.Filter, since uint64, resume bool) (*eventbus.Subscription, []model.Event, error) {
+	if !resume {
+		return a.Events.Subscribe(filter), nil, nil
+	}
+	return a.Events.SubscribeSince(filter, since)
+}
+
+// writeWebsocketEvent writes encoded event within the write deadline,
+// JSON as text message and binary encodings as binary message
+func writeWebsocketEvent(c *websocket.Conn, encoding string, e model.Event) error {
+	data, err := eventcodec.Marshal(encoding, e)
+	if err != nil {
+		return err
+	}
+
+	if err = c.SetWriteDeadline(time.Now().Add(config.Cfg.Web.WSWriteWait)); err != nil {
+		return err
+	}
+	if eventcodec.Binary(encoding) {
+		return c.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return c.WriteMessage(websocket.TextMessage, data)
+}
+
+// closeWebsocket sends close frame and waits a moment for the client to answer it
+func closeWebsocket(c *websocket.Conn, gone <-chan struct{}, code int, text string) {
+	err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text),
+		time.Now().Add(config.Cfg.Web.WSWriteWait))
+	if err != nil {
+		log.Println("Error sending close message to websocket client:", err)
+		return
+	}
+
+	select {
+	case <-gone:
+	case <-time.After(config.Cfg.Web.WSWriteWait):
+	}
+}
+
+// UserEventStream reports user and login events as Server-Sent Events, filtered by topic and acct
+// query parameters. Last-Event-ID header or since parameter replays events after the event with that ID.
+func (a *APIv1) UserEventStream(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+
+	filter, err := eventbus.ParseFilter(r.URL.Query().Get("topic"), r.URL.Query().Get("acct"))
+	if err != nil {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "acct", Reason: "Event filter is invalid: " + err.Error()})
+		return
+	}
+
+	// Browsers resume with Last-Event-ID header on their own
+	sinceQuery := r.Header.Get("Last-Event-ID")
+	if sinceQuery == "" {
+		sinceQuery = r.URL.Query().Get("since")
+	}
+	if sinceQuery != "" {
+		since, err = strconv.ParseUint(sinceQuery, 10, 64)
+		if err != nil {
+			problem.Invalid(w, r, problem.InvalidParam{Name: "since",
+				Reason: "Last-Event-ID or since parameter is invalid event ID"})
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		problem.Internal(w, r, errors.New("streaming is not supported by response writer"))
+		return
+	}
+
+	sub, missed, err := a.subscribe(filter, since, sinceQuery != "")
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	defer a.Events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // ask proxies not to buffer the stream
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Send missed events first
+	for _, e := range missed {
+		if err = writeServerSentEvent(w, e); err != nil {
+			log.Println("Write to event stream failed:", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	// Heartbeat comments keep idle connection open through proxies
+	heartbeat := time.NewTicker(config.Cfg.Web.SSEHeartbeat)
+	defer heartbeat.Stop()
+
+	// Wait and send live events to the client
+	for {
+		select {
+		case e, ok := <-sub.Messages():
+			if !ok {
+				// Channel closed by the bus, client was too slow to keep up
+				log.Println("Disconnecting slow event stream client:", r.RemoteAddr)
+				return
+			}
+			err = writeServerSentEvent(w, e)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			log.Println("Write to event stream failed:", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeServerSentEvent writes event with its ID and JSON data in text/event-stream format
+func writeServerSentEvent(w http.ResponseWriter, e model.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, data)
+	return err
+}
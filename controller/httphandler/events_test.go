@@ -0,0 +1,29 @@
+package httphandler
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"github.com/romanzac/gorilla-feast/infra/hub"
+	"testing"
+)
+
+func TestSubscribeReplaysOnlyOnResume(t *testing.T) {
+	a := &APIv1{Events: eventbus.NewBus(4, hub.DropMessage, 10)}
+	for i := 0; i < 3; i++ {
+		a.Events.Publish(model.Event{Type: model.TopicLoginFailed})
+	}
+
+	// New clients get live events only, the history is not replayed to them
+	sub, missed, err := a.subscribe(eventbus.Filter{}, 0, false)
+	if err != nil || len(missed) != 0 {
+		t.Errorf("New client got %d replayed events, error %v", len(missed), err)
+	}
+	a.Events.Unsubscribe(sub)
+
+	// Resuming clients get events after since, even since=0
+	sub, missed, err = a.subscribe(eventbus.Filter{}, 0, true)
+	if err != nil || len(missed) != 3 {
+		t.Errorf("Resuming client got %d replayed events instead of 3, error %v", len(missed), err)
+	}
+	a.Events.Unsubscribe(sub)
+}
@@ -0,0 +1,112 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// formInput is input of a handler which can be sent as form values or JSON object
+type formInput interface {
+	fromForm(r *http.Request)
+}
+
+// signupInput carries values of SignupUser
+type signupInput struct {
+	Acct     string `json:"acct"`
+	Fullname string `json:"fullname"`
+	Pwd      string `json:"pwd"`
+}
+
+func (in *signupInput) fromForm(r *http.Request) {
+	in.Acct = r.FormValue("acct")
+	in.Fullname = r.FormValue("fullname")
+	in.Pwd = r.FormValue("pwd")
+}
+
+// loginInput carries values of Login
+type loginInput struct {
+	Acct string `json:"acct"`
+	Pwd  string `json:"pwd"`
+}
+
+func (in *loginInput) fromForm(r *http.Request) {
+	in.Acct = r.FormValue("acct")
+	in.Pwd = r.FormValue("pwd")
+}
+
+// updateInput carries values of UpdateUser, acct comes from the path
+type updateInput struct {
+	Fullname string `json:"fullname"`
+	Pwd      string `json:"pwd"`
+}
+
+func (in *updateInput) fromForm(r *http.Request) {
+	in.Fullname = r.FormValue("fullname")
+	in.Pwd = r.FormValue("pwd")
+}
+
+// readInput fills in from JSON body when Content-Type is application/json, from urlencoded or
+// multipart form values otherwise. JSON must be one object without unknown fields, bodies over
+// MaxBodySize are refused. It answers the client and returns false when the input cannot be read.
+func readInput(w http.ResponseWriter, r *http.Request, in formInput) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, config.Cfg.Web.MaxBodySize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		// The whole body fits in memory, nothing is written to temporary files
+		if err := r.ParseMultipartForm(config.Cfg.Web.MaxBodySize); err != nil {
+			readInputError(w, r, err)
+			return false
+		}
+		in.fromForm(r)
+		return true
+	}
+	if mediaType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			readInputError(w, r, err)
+			return false
+		}
+		in.fromForm(r)
+		return true
+	}
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(in); err != nil {
+		readInputError(w, r, err)
+		return false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		problem.Error(w, r, http.StatusBadRequest, "Request body must contain one JSON object")
+		return false
+	}
+
+	return true
+}
+
+// readInputError answers client whose input could not be read
+func readInputError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		problem.Error(w, r, http.StatusRequestEntityTooLarge, "Request body is too large")
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		problem.Error(w, r, http.StatusBadRequest, "Request body is not valid JSON")
+	case errors.As(err, &typeErr):
+		problem.Invalid(w, r, problem.InvalidParam{Name: typeErr.Field, Reason: "Field must be a string"})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+		problem.Invalid(w, r, problem.InvalidParam{Name: field, Reason: "Field is not known"})
+	default:
+		problem.Error(w, r, http.StatusBadRequest, "Request body is invalid")
+	}
+}
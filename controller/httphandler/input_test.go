@@ -0,0 +1,63 @@
+package httphandler
+
+import (
+	"bytes"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReadInput(t *testing.T) {
+	config.Cfg.Web.MaxBodySize = 1024
+	want := signupInput{Acct: "jacky_yang", Fullname: "Jacky Yang", Pwd: "secret123"}
+
+	// multipartBody encodes fields like curl -F
+	multipartBody := func(fields map[string]string) (string, string) {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		for name, value := range fields {
+			_ = mw.WriteField(name, value)
+		}
+		_ = mw.Close()
+		return b.String(), mw.FormDataContentType()
+	}
+	fields := map[string]string{"acct": want.Acct, "fullname": want.Fullname, "pwd": want.Pwd}
+	multi, multiType := multipartBody(fields)
+	large, largeType := multipartBody(map[string]string{"acct": want.Acct, "fullname": strings.Repeat("J", 2048)})
+	form := url.Values{"acct": {want.Acct}, "fullname": {want.Fullname}, "pwd": {want.Pwd}}.Encode()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"multipart", multiType, multi, 0},
+		{"urlencoded", "application/x-www-form-urlencoded", form, 0},
+		{"json", "application/json", `{"acct":"jacky_yang","fullname":"Jacky Yang","pwd":"secret123"}`, 0},
+		{"multipart too large", largeType, large, http.StatusRequestEntityTooLarge},
+		{"multipart without boundary", "multipart/form-data", multi, http.StatusBadRequest},
+		{"json unknown field", "application/json", `{"acct":"jacky_yang","role":"admin"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/v1/user", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		w := httptest.NewRecorder()
+
+		var in signupInput
+		ok := readInput(w, r, &in)
+		if tt.status != 0 {
+			if ok || w.Code != tt.status {
+				t.Errorf("%s: read %v with status %d, want %d", tt.name, ok, w.Code, tt.status)
+			}
+			continue
+		}
+		if !ok || in != want {
+			t.Errorf("%s: read %v %+v, want %+v: %s", tt.name, ok, in, want, w.Body.String())
+		}
+	}
+}
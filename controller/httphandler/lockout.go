@@ -0,0 +1,137 @@
+package httphandler
+
+import (
+	"sync"
+	"time"
+)
+
+// maxLockoutAccts bounds accts tracked by the lockout, logins of unknown accts are counted too
+const maxLockoutAccts = 10000
+
+// loginLockout counts failed logins per acct and locks the acct after too many of them
+type loginLockout struct {
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	locked    map[string]time.Time
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	now       func() time.Time
+}
+
+// newLoginLockout creates lockout for threshold failures within window, zero threshold disables it
+func newLoginLockout(threshold int, window, duration time.Duration) *loginLockout {
+	return &loginLockout{
+		failures:  make(map[string][]time.Time),
+		locked:    make(map[string]time.Time),
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		now:       time.Now,
+	}
+}
+
+// Locked reports whether acct is locked now
+func (l *loginLockout) Locked(acct string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.locked[acct]
+	if ok && l.now().After(until) {
+		delete(l.locked, acct)
+		return false
+	}
+	return ok
+}
+
+// Fail records failed login and reports whether it has just locked the acct
+func (l *loginLockout) Fail(acct string) bool {
+	if l.threshold <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if until, ok := l.locked[acct]; ok && now.Before(until) {
+		return false
+	}
+
+	recent := l.recent(acct, now)
+	recent = append(recent, now)
+	if _, ok := l.failures[acct]; !ok {
+		l.makeRoom(now)
+	}
+
+	if len(recent) < l.threshold {
+		l.failures[acct] = recent
+		return false
+	}
+
+	delete(l.failures, acct)
+	l.locked[acct] = now.Add(l.duration)
+	return true
+}
+
+// Succeed forgets failed logins of acct
+func (l *loginLockout) Succeed(acct string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, acct)
+}
+
+// recent keeps only failures of acct within the window, the acct is forgotten when none is left
+func (l *loginLockout) recent(acct string, now time.Time) []time.Time {
+	recent := l.failures[acct][:0]
+	for _, t := range l.failures[acct] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(l.failures, acct)
+	}
+	return recent
+}
+
+// makeRoom removes accts without failures within the window and expired locks when the lockout
+// tracks maxLockoutAccts, then the acct whose last failure is the oldest or, without failures,
+// the lock which expires the soonest when it is still full
+func (l *loginLockout) makeRoom(now time.Time) {
+	if len(l.failures)+len(l.locked) < maxLockoutAccts {
+		return
+	}
+
+	for acct := range l.failures {
+		l.recent(acct, now)
+	}
+	for acct, until := range l.locked {
+		if now.After(until) {
+			delete(l.locked, acct)
+		}
+	}
+	if len(l.failures)+len(l.locked) < maxLockoutAccts {
+		return
+	}
+
+	var oldest string
+	var oldestTime time.Time
+	for acct, times := range l.failures {
+		if last := times[len(times)-1]; oldest == "" || last.Before(oldestTime) {
+			oldest, oldestTime = acct, last
+		}
+	}
+	if oldest != "" {
+		delete(l.failures, oldest)
+		return
+	}
+
+	for acct, until := range l.locked {
+		if oldest == "" || until.Before(oldestTime) {
+			oldest, oldestTime = acct, until
+		}
+	}
+	delete(l.locked, oldest)
+}
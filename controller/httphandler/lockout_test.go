@@ -0,0 +1,95 @@
+package httphandler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoginLockout(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLoginLockout(3, time.Minute, time.Hour)
+	l.now = func() time.Time { return now }
+
+	if l.Fail("jacky") || l.Fail("jacky") {
+		t.Fatal("locked before threshold")
+	}
+	if !l.Fail("jacky") || !l.Locked("jacky") {
+		t.Fatal("not locked at threshold")
+	}
+
+	now = now.Add(time.Hour + time.Second)
+	if l.Locked("jacky") {
+		t.Error("lock did not expire")
+	}
+
+	// Failures outside the window do not count and their acct is forgotten
+	l.Fail("mary")
+	now = now.Add(2 * time.Minute)
+	l.Fail("mary")
+	if n := len(l.failures["mary"]); n != 1 {
+		t.Errorf("failures within window: %d", n)
+	}
+	now = now.Add(2 * time.Minute)
+	l.Succeed("mary")
+	if _, ok := l.failures["mary"]; ok {
+		t.Error("acct kept after success")
+	}
+}
+
+func TestLoginLockoutBounded(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLoginLockout(3, time.Minute, time.Hour)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < maxLockoutAccts; i++ {
+		l.Fail("spray" + strconv.Itoa(i))
+		now = now.Add(time.Millisecond)
+	}
+	l.Fail("jacky")
+	if n := len(l.failures); n != maxLockoutAccts {
+		t.Errorf("tracked accts over the cap: %d", n)
+	}
+	if _, ok := l.failures["spray0"]; ok {
+		t.Error("oldest acct kept when full")
+	}
+
+	// Accts without failures within the window are pruned
+	now = now.Add(2 * time.Minute)
+	l.Fail("mary")
+	if n := len(l.failures); n != 1 {
+		t.Errorf("tracked accts after the window: %d", n)
+	}
+}
+
+func TestLoginLockoutBoundedLocks(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLoginLockout(1, time.Minute, time.Hour)
+	l.now = func() time.Time { return now }
+
+	// Every failure locks a random acct, locks are bounded too
+	for i := 0; i <= maxLockoutAccts; i++ {
+		if !l.Fail("spray" + strconv.Itoa(i)) {
+			t.Fatalf("acct %d was not locked", i)
+		}
+		now = now.Add(time.Millisecond)
+	}
+	if n := len(l.failures) + len(l.locked); n != maxLockoutAccts {
+		t.Errorf("tracked accts over the cap: %d", n)
+	}
+	if l.Locked("spray0") || !l.Locked("spray1") || !l.Locked("spray"+strconv.Itoa(maxLockoutAccts)) {
+		t.Error("lock which expires the soonest was not the one removed")
+	}
+
+	// Failures of another acct evict a lock as well, the failure is kept
+	l = newLoginLockout(2, time.Minute, time.Hour)
+	l.now = func() time.Time { return now }
+	for i := 0; i < maxLockoutAccts; i++ {
+		l.Fail("spray" + strconv.Itoa(i))
+		l.Fail("spray" + strconv.Itoa(i))
+	}
+	l.Fail("jacky")
+	if n := len(l.failures) + len(l.locked); n != maxLockoutAccts || len(l.failures) != 1 {
+		t.Errorf("tracked %d failures and %d locks", len(l.failures), len(l.locked))
+	}
+}
@@ -0,0 +1,15 @@
+package httphandler
+
+import (
+	"github.com/romanzac/gorilla-feast/infra/openapi"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"net/http"
+)
+
+// OpenAPIDocument sends OpenAPI document describing v1 routes
+func (a *APIv1) OpenAPIDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openapi.Document); err != nil {
+		problem.Internal(w, r, err)
+	}
+}
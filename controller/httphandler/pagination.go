@@ -0,0 +1,216 @@
+package httphandler
+
+import (
+	"fmt"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/filter"
+	"github.com/romanzac/gorilla-feast/infra/pagination"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sortableFields maps user fields lists can be sorted by to their SQL expressions. Fullnames
+// without value sort as empty ones and they are compared with SortCollation.
+func sortableFields() map[string]string {
+	fullname := "COALESCE(fullname, '')"
+	if c := config.Cfg.Web.SortCollation; c != "" {
+		fullname += ` COLLATE "` + c + `"`
+	}
+	return map[string]string{
+		"acct":       "acct",
+		"fullname":   fullname,
+		"created_at": "created_at",
+		"updated_at": "updated_at",
+	}
+}
+
+// filterableFields are user fields lists can be filtered on
+var filterableFields = map[string]filter.Field{
+	"acct":       {Column: "acct", Type: filter.Text},
+	"fullname":   {Column: "fullname", Type: filter.Text},
+	"created_at": {Column: "created_at", Type: filter.Time},
+	"updated_at": {Column: "updated_at", Type: filter.Time},
+}
+
+// userPage is the response of ListAllUsers with opaque cursors of neighbouring pages
+type userPage struct {
+	Users []model.User `json:"users"`
+	Next  string       `json:"next,omitempty"`
+	Prev  string       `json:"prev,omitempty"`
+	Total *int64       `json:"total,omitempty"`
+}
+
+// sortByRelevance is the ordering of search results in their cursors
+const sortByRelevance = "relevance"
+
+// readPageParams reads cursor, limit, filter and count parameters of a list ordered by sortBy
+// unless the cursor carries another ordering. Invalid parameters are answered with false.
+func readPageParams(w http.ResponseWriter, r *http.Request, sortBy string) (repository.UserPageQuery, string, bool) {
+	var (
+		q   = repository.UserPageQuery{Limit: config.Cfg.Web.PageSize}
+		err error
+	)
+
+	// Cursor carries its own ordering, which must not change between pages
+	if cursorQuery := r.URL.Query().Get("cursor"); cursorQuery != "" {
+		c, err := pagination.Decode(cursorQuery)
+		if err != nil || (r.URL.Query().Has("sortBy") && c.Sort != sortBy) {
+			problem.Invalid(w, r, problem.InvalidParam{Name: "cursor", Reason: "Cursor is invalid or does not match sortBy"})
+			return q, sortBy, false
+		}
+		sortBy, q.After, q.Before = c.Sort, c.Values, c.Before
+	}
+
+	limitQuery := r.URL.Query().Get("limit")
+	if limitQuery != "" {
+		q.Limit, err = strconv.Atoi(limitQuery)
+		if err != nil || q.Limit < 1 {
+			problem.Invalid(w, r, problem.InvalidParam{Name: "limit", Reason: "limit parameter is invalid number"})
+			return q, sortBy, false
+		}
+		if q.Limit > config.Cfg.Web.MaxPageSize {
+			q.Limit = config.Cfg.Web.MaxPageSize
+		}
+	}
+
+	if filterQuery := r.URL.Query().Get("filter"); filterQuery != "" {
+		q.Filter, q.FilterArgs, err = filter.Parse(filterQuery, filterableFields)
+		if err != nil {
+			problem.Invalid(w, r, problem.InvalidParam{Name: "filter", Reason: "Filter parameter is invalid: " + err.Error()})
+			return q, sortBy, false
+		}
+	}
+
+	countQuery := r.URL.Query().Get("count")
+	if countQuery != "" {
+		q.Count, err = strconv.ParseBool(countQuery)
+		if err != nil {
+			problem.Invalid(w, r, problem.InvalidParam{Name: "count", Reason: "count parameter is not true or false"})
+			return q, sortBy, false
+		}
+	}
+
+	return q, sortBy, true
+}
+
+// pageCursors makes cursors pointing after the last and before the first of n rows read with q,
+// values returns sort key values of i-th row
+func pageCursors(q repository.UserPageQuery, sortBy string, n int, more bool,
+	values func(i int) []string) (next, prev string) {
+	// Reading forwards, next page exists when more rows follow and previous one when reading
+	// started after cursor. Reading backwards it is the other way round.
+	hasNext, hasPrev := more, len(q.After) > 0
+	if q.Before {
+		hasNext, hasPrev = hasPrev, hasNext
+	}
+
+	if n > 0 && hasNext {
+		next = pagination.Cursor{Sort: sortBy, Values: values(n - 1)}.Encode()
+	}
+	if n > 0 && hasPrev {
+		prev = pagination.Cursor{Sort: sortBy, Values: values(0), Before: true}.Encode()
+	}
+	return next, prev
+}
+
+// newUserPage makes response of page with cursors of neighbouring pages
+func newUserPage(page repository.UserPage, q repository.UserPageQuery, sortBy string) userPage {
+	resp := userPage{Users: page.Users}
+	if resp.Users == nil {
+		resp.Users = []model.User{}
+	}
+	if q.Count {
+		resp.Total = &page.Total
+	}
+
+	resp.Next, resp.Prev = pageCursors(q, sortBy, len(page.Users), page.More, func(i int) []string {
+		return cursorValues(page.Users[i], q.Sort)
+	})
+
+	// Timestamps are read only for ordering, the list shows acct and fullname
+	for i := range resp.Users {
+		resp.Users[i].CreatedAt, resp.Users[i].UpdatedAt = nil, nil
+	}
+
+	return resp
+}
+
+// userSearchPage is the response of SearchUsers, best matches first
+type userSearchPage struct {
+	Users []model.UserMatch `json:"users"`
+	Next  string            `json:"next,omitempty"`
+	Prev  string            `json:"prev,omitempty"`
+	Total *int64            `json:"total,omitempty"`
+}
+
+// newUserSearchPage makes response of search results with cursors of neighbouring pages
+func newUserSearchPage(page repository.UserSearchPage, q repository.UserPageQuery) userSearchPage {
+	resp := userSearchPage{Users: page.Matches}
+	if resp.Users == nil {
+		resp.Users = []model.UserMatch{}
+	}
+	if q.Count {
+		resp.Total = &page.Total
+	}
+
+	// Rank is real number in Postgres, its shortest form reads back as the same value
+	resp.Next, resp.Prev = pageCursors(q, sortByRelevance, len(page.Matches), page.More, func(i int) []string {
+		m := page.Matches[i]
+		return []string{strconv.FormatFloat(m.Rank, 'g', -1, 32), m.Acct}
+	})
+
+	return resp
+}
+
+// cursorValues returns values of sort keys of user
+func cursorValues(u model.User, keys []pagination.Key) []string {
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = cursorValue(u, k.Column)
+	}
+	return values
+}
+
+// cursorValue returns value of sortable user field
+func cursorValue(u model.User, field string) string {
+	timestamp := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+
+	switch field {
+	case "acct":
+		return u.Acct
+	case "fullname":
+		return u.Fullname
+	case "created_at":
+		return timestamp(u.CreatedAt)
+	case "updated_at":
+		return timestamp(u.UpdatedAt)
+	}
+	return ""
+}
+
+// writePageLinks adds Link headers of the next and previous pages which exist
+func writePageLinks(w http.ResponseWriter, r *http.Request, next, prev string) {
+	for _, link := range []struct{ cursor, rel string }{{next, "next"}, {prev, "prev"}} {
+		if link.cursor != "" {
+			w.Header().Add("Link", pageLink(r, link.cursor, link.rel))
+		}
+	}
+}
+
+// pageLink returns Link header value of the request URL with another cursor
+func pageLink(r *http.Request, cursor, rel string) string {
+	u := *r.URL
+	query := u.Query()
+	query.Set("cursor", cursor)
+	u.RawQuery = query.Encode()
+	return fmt.Sprintf("<%s>; rel=\"%s\"", u.RequestURI(), rel)
+}
@@ -0,0 +1,72 @@
+package httphandler
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/pagination"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestSearchCursorRank(t *testing.T) {
+	// Ranks are Postgres real numbers read into float64, their cursor value must parse back
+	// as the same real, otherwise the next page skips or repeats matches of equal rank
+	ranks := []float32{0, 1, 0.3, 1.0 / 3, 2.0 / 3, 0.8333333, 0.571428571, math.SmallestNonzeroFloat32,
+		math.Nextafter32(0.5, 1), math.Nextafter32(0.5, 0)}
+	for _, rank := range ranks {
+		page := repository.UserSearchPage{More: true,
+			Matches: []model.UserMatch{{Acct: "jacky_yang", Rank: float64(rank)}}}
+		resp := newUserSearchPage(page, repository.UserPageQuery{Limit: 1})
+
+		c, err := pagination.Decode(resp.Next)
+		if err != nil || c.Sort != sortByRelevance || len(c.Values) != 2 || c.Values[1] != "jacky_yang" {
+			t.Fatalf("Cursor of rank %v is wrong: %+v, %v", rank, c, err)
+		}
+		parsed, err := strconv.ParseFloat(c.Values[0], 32)
+		if err != nil || float32(parsed) != rank {
+			t.Errorf("Rank %v went to cursor as %q, which reads back as %v", rank, c.Values[0], parsed)
+		}
+	}
+}
+
+func TestPageCursors(t *testing.T) {
+	values := func(i int) []string { return []string{strconv.Itoa(i)} }
+	tests := []struct {
+		name       string
+		q          repository.UserPageQuery
+		n          int
+		more       bool
+		next, prev []string
+	}{
+		{"first page", repository.UserPageQuery{}, 3, true, []string{"2"}, nil},
+		{"only page", repository.UserPageQuery{}, 3, false, nil, nil},
+		{"middle page", repository.UserPageQuery{After: []string{"x"}}, 3, true, []string{"2"}, []string{"0"}},
+		{"last page", repository.UserPageQuery{After: []string{"x"}}, 3, false, nil, []string{"0"}},
+		{"backwards to first page", repository.UserPageQuery{After: []string{"x"}, Before: true}, 3, false,
+			[]string{"2"}, nil},
+		{"backwards", repository.UserPageQuery{After: []string{"x"}, Before: true}, 3, true,
+			[]string{"2"}, []string{"0"}},
+		{"empty page", repository.UserPageQuery{After: []string{"x"}}, 0, false, nil, nil},
+	}
+	for _, tt := range tests {
+		next, prev := pageCursors(tt.q, sortByRelevance, tt.n, tt.more, values)
+		for _, cursor := range []struct {
+			name, encoded string
+			want          []string
+			before        bool
+		}{{"next", next, tt.next, false}, {"prev", prev, tt.prev, true}} {
+			if cursor.want == nil {
+				if cursor.encoded != "" {
+					t.Errorf("%s: unexpected %s cursor", tt.name, cursor.name)
+				}
+				continue
+			}
+			c, err := pagination.Decode(cursor.encoded)
+			if err != nil || c.Sort != sortByRelevance || c.Before != cursor.before ||
+				len(c.Values) != 1 || c.Values[0] != cursor.want[0] {
+				t.Errorf("%s: %s cursor is %+v, %v, want values %v", tt.name, cursor.name, c, err, cursor.want)
+			}
+		}
+	}
+}
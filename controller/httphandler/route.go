@@ -2,6 +2,10 @@ package httphandler
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/idempotency"
+	"github.com/romanzac/gorilla-feast/infra/openapi"
+	"github.com/romanzac/gorilla-feast/infra/problem"
 	"github.com/romanzac/gorilla-feast/middleware"
 	"net/http"
 )
@@ -9,25 +13,54 @@ import (
 // InitRoutes for Gorilla Feast
 func InitRoutes(r *mux.Router, apiv1 *APIv1) {
 
+	// Every request gets ID, which is returned in problem responses. Identity comes from tokens only.
+	r.Use(middleware.RequestID, middleware.ClearIdentity)
+	r.NotFoundHandler = middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		problem.Error(w, r, http.StatusNotFound, "No route matches the URL")
+	}))
+	r.MethodNotAllowedHandler = middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		problem.Error(w, r, http.StatusMethodNotAllowed, "Method is not allowed for the URL")
+	}))
+
 	// Test route
 	r.HandleFunc("/ping", apiv1.PingPong)
 
+	// API description
+	r.HandleFunc("/api/openapi.json", apiv1.OpenAPIDocument).
+		Methods("GET")
+
 	// WebSocket routes
-	r.HandleFunc("/login-failures", apiv1.LoginFailures)
+	r.Handle("/login-failures",
+		middleware.WSJWTHandler(http.HandlerFunc(apiv1.LoginFailures)))
+
+	r.Handle("/events",
+		middleware.WSJWTHandler(http.HandlerFunc(apiv1.UserEvents)))
+
+	// Server-Sent Events routes
+	r.Handle("/events/stream",
+		middleware.WSJWTHandler(http.HandlerFunc(apiv1.UserEventStream)))
 
 	v1 := r.PathPrefix("/api/v1").Subrouter()
+	if config.Cfg.Web.ValidateRequests {
+		v1.Use(openapi.Validate)
+	}
 
-	// User routes
+	// User routes, POST requests other than login can be retried with Idempotency-Key
 	v1.HandleFunc("/login", apiv1.Login).
 		Methods("POST")
 
-	v1.HandleFunc("/user", apiv1.SignupUser).
+	v1.Handle("/user",
+		idempotency.Keys.AnonymousHandler("signup", http.HandlerFunc(apiv1.SignupUser))).
 		Methods("POST")
 
 	v1.Handle("/user",
 		middleware.JWTHandler(http.HandlerFunc(apiv1.ListAllUsers))).
 		Methods("GET")
 
+	v1.Handle("/user/search",
+		middleware.JWTHandler(http.HandlerFunc(apiv1.SearchUsers))).
+		Methods("GET")
+
 	v1.Handle("/user/{fullname}",
 		middleware.JWTHandler(http.HandlerFunc(apiv1.SearchUserbyFullname))).
 		Methods("GET")
@@ -43,4 +76,27 @@ func InitRoutes(r *mux.Router, apiv1 *APIv1) {
 	v1.Handle("/user/{acct}",
 		middleware.JWTHandler(http.HandlerFunc(apiv1.DeleteUser))).
 		Methods("DELETE")
+
+	// Webhook routes
+	v1.Handle("/webhook",
+		middleware.JWTHandler(middleware.AdminHandler(
+			idempotency.Keys.Handler(http.HandlerFunc(apiv1.RegisterWebhook))))).
+		Methods("POST")
+
+	v1.Handle("/webhook",
+		middleware.JWTHandler(middleware.AdminHandler(http.HandlerFunc(apiv1.ListWebhooks)))).
+		Methods("GET")
+
+	v1.Handle("/webhook/dead-letter",
+		middleware.JWTHandler(middleware.AdminHandler(http.HandlerFunc(apiv1.ListWebhookDeadLetters)))).
+		Methods("GET")
+
+	v1.Handle("/webhook/dead-letter/{id:[0-9]+}/redeliver",
+		middleware.JWTHandler(middleware.AdminHandler(
+			idempotency.Keys.Handler(http.HandlerFunc(apiv1.RedeliverWebhookDeadLetter))))).
+		Methods("POST")
+
+	v1.Handle("/webhook/{id:[0-9]+}",
+		middleware.JWTHandler(middleware.AdminHandler(http.HandlerFunc(apiv1.DeleteWebhook)))).
+		Methods("DELETE")
 }
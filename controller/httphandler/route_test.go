@@ -0,0 +1,69 @@
+package httphandler
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/romanzac/gorilla-feast/infra/openapi"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestRoutesMatchOpenAPI keeps OpenAPI document in sync with v1 routes in both directions
+func TestRoutesMatchOpenAPI(t *testing.T) {
+	r := mux.NewRouter()
+	InitRoutes(r, &APIv1{})
+
+	var routes []string
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tmpl, "/api/v1/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, m := range methods {
+			routes = append(routes, m+" "+openapi.PathTemplate(tmpl))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(routes)
+
+	documented := make(map[string]bool)
+	for _, op := range openapi.Operations() {
+		documented[op] = true
+	}
+	for _, route := range routes {
+		if !documented[route] {
+			t.Errorf("Route %s is missing in OpenAPI document", route)
+		}
+		delete(documented, route)
+	}
+	for op := range documented {
+		t.Errorf("Operation %s of OpenAPI document has no route", op)
+	}
+}
+
+// TestRoutesClearIdentity keeps clients from choosing acct and role of requests without token
+func TestRoutesClearIdentity(t *testing.T) {
+	r := mux.NewRouter()
+	InitRoutes(r, &APIv1{})
+	r.HandleFunc("/identity", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("acct") + r.Header.Get("role")))
+	})
+
+	req := httptest.NewRequest("GET", "/identity", nil)
+	req.Header.Set("acct", "admin")
+	req.Header.Set("role", "admin")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Body.String() != "" {
+		t.Errorf("Client supplied identity %q reached the handler", w.Body.String())
+	}
+}
@@ -0,0 +1,144 @@
+package httphandler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Bounds of webhook secret length, the longest fits the database column
+const (
+	minSecretLength = 16
+	maxSecretLength = 100
+)
+
+// RegisterWebhook adds endpoint which receives events of given types, all types when none are given.
+// Secret for signatures is generated unless provided and it is returned only in this response.
+func (a *APIv1) RegisterWebhook(w http.ResponseWriter, r *http.Request) {
+
+	hookURL := r.FormValue("url")
+	eventTypes := r.FormValue("event_types")
+	secret := r.FormValue("secret")
+
+	// Validate URL
+	u, err := url.Parse(hookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "url", Reason: "URL is not valid http or https address"})
+		return
+	}
+
+	// Normalize comma separated event types
+	var types []string
+	for _, t := range strings.Split(eventTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+
+	// Validate secret for length or generate one
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err = rand.Read(b); err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		secret = hex.EncodeToString(b)
+	}
+	if len(secret) < minSecretLength {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "secret", Reason: "Secret length is less than 16 characters"})
+		return
+	}
+	if len(secret) > maxSecretLength {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "secret", Reason: "Secret length is more than 100 characters"})
+		return
+	}
+
+	hook, err := a.WebhookRepo.Create(hookURL, strings.Join(types, ","), secret)
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+	a.Webhooks.Reload()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(hook); err != nil {
+		problem.Internal(w, r, err)
+	}
+}
+
+// ListWebhooks sends all registered webhooks without their secrets
+func (a *APIv1) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := a.WebhookRepo.FindAll()
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(hooks); err != nil {
+		problem.Internal(w, r, err)
+	}
+}
+
+// DeleteWebhook removes webhook together with its dead letters
+func (a *APIv1) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "id", Reason: "Webhook ID is not valid number"})
+		return
+	}
+
+	if err = a.WebhookRepo.Delete(id); err != nil {
+		repositoryError(w, r, err, "Webhook")
+		return
+	}
+	a.Webhooks.Reload()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode("Webhook deleted successfully"); err != nil {
+		problem.Internal(w, r, err)
+	}
+}
+
+// ListWebhookDeadLetters sends events which could not be delivered to webhooks
+func (a *APIv1) ListWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetters, err := a.WebhookRepo.FindDeadLetters()
+	if err != nil {
+		problem.Internal(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(deadLetters); err != nil {
+		problem.Internal(w, r, err)
+	}
+}
+
+// RedeliverWebhookDeadLetter queues dead letter for delivery to its webhook again
+func (a *APIv1) RedeliverWebhookDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		problem.Invalid(w, r, problem.InvalidParam{Name: "id", Reason: "Dead letter ID is not valid number"})
+		return
+	}
+
+	if err = a.Webhooks.Redeliver(id); err != nil {
+		repositoryError(w, r, err, "Dead letter")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode("Dead letter queued for redelivery"); err != nil {
+		problem.Internal(w, r, err)
+	}
+}
@@ -0,0 +1,24 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRegisterWebhookSecretLength(t *testing.T) {
+	a := &APIv1{}
+	for _, secret := range []string{strings.Repeat("s", 15), strings.Repeat("s", 101)} {
+		form := url.Values{"url": {"https://example.com/hook"}, "secret": {secret}}
+		r := httptest.NewRequest("POST", "/api/v1/webhook", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		a.RegisterWebhook(w, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"secret"`) {
+			t.Errorf("Secret of %d characters: %d %s", len(secret), w.Code, w.Body.String())
+		}
+	}
+}
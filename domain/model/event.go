@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+)
+
+// Event topics
+const (
+	TopicUserCreated    = "user.created"
+	TopicUserUpdated    = "user.updated"
+	TopicUserDeleted    = "user.deleted"
+	TopicLoginSucceeded = "login.succeeded"
+	TopicLoginFailed    = "login.failed"
+	TopicUserLocked     = "user.locked"
+)
+
+// Event represents something which happened to a user
+type Event struct {
+	ID     uint64    `gorm:"primaryKey;autoIncrement:false" json:"id"`
+	Type   string    `json:"type"`
+	Acct   string    `json:"acct"`
+	Time   time.Time `json:"time"`
+	Detail string    `json:"detail,omitempty"`
+}
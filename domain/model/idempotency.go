@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// IdempotencyKey keeps the first response to a request sent with Idempotency-Key header until it expires,
+// Status is zero while the request is in progress. A request in progress holds the key until LockedUntil,
+// then a retry takes it over, e.g. after the replica running the request crashed.
+type IdempotencyKey struct {
+	ID          string `gorm:"primaryKey"`
+	Fingerprint string
+	Status      int
+	Header      string
+	Body        []byte
+	ExpiresAt   time.Time
+	LockedUntil time.Time
+}
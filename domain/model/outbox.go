@@ -0,0 +1,15 @@
+package model
+
+import (
+	"time"
+)
+
+// OutboxEvent represents event written in the same transaction as the change it describes,
+// it waits in the outbox until it is published
+type OutboxEvent struct {
+	ID     uint64 `gorm:"primaryKey"`
+	Type   string
+	Acct   string
+	Time   time.Time
+	Detail string
+}
@@ -9,6 +9,15 @@ type User struct {
 	Acct      string     `gorm:"primary_key"  json:"acct"`
 	Pwd       string     `json:"-"`
 	Fullname  string     `json:"fullname,omitempty"`
+	Role      string     `gorm:"default:user" json:"role,omitempty"`
 	CreatedAt *time.Time `json:"created_at,omitempty"`
 	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Version   int64      `gorm:"default:1" json:"-"`
+}
+
+// UserMatch is a user found by search with relevance of the match from 0 to 1
+type UserMatch struct {
+	Acct     string  `json:"acct"`
+	Fullname string  `json:"fullname,omitempty"`
+	Rank     float64 `json:"rank"`
 }
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"time"
+)
+
+// Webhook represents endpoint which receives events of given types
+type Webhook struct {
+	ID         uint64     `gorm:"primaryKey" json:"id"`
+	URL        string     `json:"url"`
+	EventTypes string     `json:"event_types"`
+	Secret     string     `json:"secret,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+}
+
+// WebhookDelivery represents event waiting for delivery to webhook, deliveries of one webhook
+// go out in ID order
+type WebhookDelivery struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	WebhookID     uint64    `json:"webhook_id"`
+	EventID       uint64    `json:"event_id"`
+	Topic         string    `json:"topic"`
+	Payload       string    `json:"payload"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// WebhookDeadLetter represents event which could not be delivered to webhook
+type WebhookDeadLetter struct {
+	ID        uint64     `gorm:"primaryKey" json:"id"`
+	WebhookID uint64     `json:"webhook_id"`
+	EventID   uint64     `json:"event_id"`
+	Payload   string     `json:"payload"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
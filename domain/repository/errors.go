@@ -0,0 +1,35 @@
+package repository
+
+import "errors"
+
+// ErrInvalidCredentials is the only login error clients get to see, so a response
+// does not tell whether the acct exists or the password was wrong
+var ErrInvalidCredentials = errors.New("invalid acct or password")
+
+// ErrAlreadyExists occurs when a user, webhook or other record with the same key already exists
+var ErrAlreadyExists = errors.New("already exists")
+
+// ErrNotFound occurs when the user or other record to read or change does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrPreconditionFailed occurs when the record was changed since the version a change is based on
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrConflict occurs when a change collides with the current state or a concurrent change
+var ErrConflict = errors.New("conflict")
+
+// CredentialsError keeps the detailed reason of a failed login for logs and internal events.
+// It matches ErrInvalidCredentials with errors.Is
+type CredentialsError struct {
+	Acct   string
+	Reason string
+}
+
+func (e *CredentialsError) Error() string {
+	return e.Reason + " for user \"" + e.Acct + "\""
+}
+
+// Is makes every CredentialsError equal to ErrInvalidCredentials
+func (e *CredentialsError) Is(target error) bool {
+	return target == ErrInvalidCredentials
+}
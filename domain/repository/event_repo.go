@@ -0,0 +1,12 @@
+package repository
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+)
+
+// EventRepository interface for keeping published events.
+type EventRepository interface {
+	Save(e model.Event) error
+	Since(id uint64, limit int) ([]model.Event, error)
+	LastID() (uint64, error)
+}
@@ -0,0 +1,16 @@
+package repository
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"time"
+)
+
+// IdempotencyRepository interface for responses stored under idempotency keys.
+type IdempotencyRepository interface {
+	Claim(k model.IdempotencyKey, now time.Time) (model.IdempotencyKey, bool, error)
+
+	// Complete and Release change the key only while it is held by the claim k
+	Complete(k model.IdempotencyKey) error
+	Release(k model.IdempotencyKey) error
+	DeleteExpired(now time.Time) (int64, error)
+}
@@ -0,0 +1,10 @@
+package repository
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+)
+
+// OutboxRepository interface for events waiting to be published.
+type OutboxRepository interface {
+	Drain(limit int, relay func(e model.OutboxEvent) ([]model.WebhookDelivery, error)) (int, error)
+}
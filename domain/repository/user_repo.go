@@ -2,14 +2,64 @@ package repository
 
 import (
 	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/pagination"
 	"github.com/romanzac/gorilla-feast/middleware"
+	"time"
 )
 
 // UserRepository interface for basic operations with Users.
 type UserRepository interface {
 	Find(acct, fullname, sortQuery string, limit, offset int, noDetail bool) ([]model.User, error)
+	FindPage(q UserPageQuery) (UserPage, error)
+	Search(text string, q UserPageQuery) (UserSearchPage, error)
 	Create(acct, fullname, pwd string) error
-	Update(acct, fullname, pwd string) error
-	Delete(acct string) error
-	Validate(acct, pwd string) (middleware.JWTToken, error)
+
+	// Update and Delete change the user only when its version is one of versions,
+	// nil versions allow any. Update returns the new version.
+	Update(acct, fullname, pwd string, versions []UserVersion) (UserVersion, error)
+	Delete(acct string, versions []UserVersion) error
+
+	// Validate checks normalized pwd. Passwords hashed before normalization are checked
+	// with rawPwd as it was sent and their hash is replaced with one of pwd.
+	Validate(acct, pwd, rawPwd string) (middleware.JWTToken, error)
+
+	// AddEvent writes event which comes with no change, e.g. a login, to the outbox
+	AddEvent(topic, acct, detail string) error
+}
+
+// UserVersion identifies one state of a user. Versions count from 1 again when the acct is
+// signed up after deletion, the creation time tells the users apart.
+type UserVersion struct {
+	CreatedAt time.Time
+	Version   int64
+}
+
+// UserPageQuery selects up to Limit users ordered by Sort keys, which end with acct.
+// Users after the key values in After are read, or before them when Before is set.
+// First page is read when After is empty. Filter is SQL condition with FilterArgs selecting
+// users to list and count, all users when empty.
+type UserPageQuery struct {
+	Sort       []pagination.Key
+	After      []string
+	Before     bool
+	Limit      int
+	Count      bool
+	Filter     string
+	FilterArgs []interface{}
+}
+
+// UserPage is one page of users in the order of the query. More tells whether more users
+// follow in the direction of reading, Total is the count of all users or -1 when not counted.
+type UserPage struct {
+	Users []model.User
+	More  bool
+	Total int64
+}
+
+// UserSearchPage is one page of users matching search text, ordered by the keys of the query.
+// Rank of the match may be one of the keys.
+type UserSearchPage struct {
+	Matches []model.UserMatch
+	More    bool
+	Total   int64
 }
@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"time"
+)
+
+// DeliveryResult tells what happens to webhook delivery after an attempt
+type DeliveryResult int
+
+const (
+	// DeliverySucceeded removes the delivery
+	DeliverySucceeded DeliveryResult = iota
+	// DeliveryRetried keeps the delivery for the next attempt
+	DeliveryRetried
+	// DeliveryFailed moves the delivery to dead letters
+	DeliveryFailed
+)
+
+// WebhookRepository interface for webhooks, their pending deliveries and undelivered events.
+type WebhookRepository interface {
+	FindAll() ([]model.Webhook, error)
+	Find(id uint64) (model.Webhook, error)
+	Create(url, eventTypes, secret string) (model.Webhook, error)
+	Delete(id uint64) error
+	AttemptDelivery(now time.Time, lease time.Duration,
+		attempt func(hook model.Webhook, d *model.WebhookDelivery) DeliveryResult) (bool, error)
+	FindDeadLetters() ([]model.WebhookDeadLetter, error)
+	FindDeadLetter(id uint64) (model.WebhookDeadLetter, error)
+	RequeueDeadLetter(id uint64, d model.WebhookDelivery) error
+}
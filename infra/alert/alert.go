@@ -0,0 +1,221 @@
+// Provides threshold alerts over received events. A rule fires when too many matching events
+// arrive within its window and then runs a shell command or posts to a URL with the context.
+
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAlertEvents limits how many of the latest events are sent with an alert
+const maxAlertEvents = 50
+
+// Alert is the aggregated context of a fired rule
+type Alert struct {
+	Rule      string        `json:"rule"`
+	Acct      string        `json:"acct,omitempty"`
+	Count     int           `json:"count"`
+	Threshold int           `json:"threshold"`
+	Window    string        `json:"window"`
+	First     time.Time     `json:"first"`
+	Last      time.Time     `json:"last"`
+	Events    []model.Event `json:"events"`
+}
+
+// ruleState keeps events within the window and last firing for every group of a rule,
+// groups without events and firings in cooldown are swept once per window
+type ruleState struct {
+	rule   config.AlertRule
+	filter eventbus.Filter
+	events map[string][]model.Event
+	fired  map[string]time.Time
+	swept  time.Time
+}
+
+// Engine evaluates rules over events, it is not safe for concurrent use
+type Engine struct {
+	rules []*ruleState
+}
+
+// NewEngine validates rules and creates engine for them
+func NewEngine(rules []config.AlertRule) (*Engine, error) {
+	e := &Engine{}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = "rule" + strconv.Itoa(i+1)
+		}
+		if r.Threshold < 1 || r.Window <= 0 {
+			return nil, fmt.Errorf("alert %s: threshold and window must be positive", r.Name)
+		}
+		if r.Command == "" && r.URL == "" {
+			return nil, fmt.Errorf("alert %s: command or url is required", r.Name)
+		}
+		filter, err := eventbus.ParseFilter(r.Type, r.Acct)
+		if err != nil {
+			return nil, fmt.Errorf("alert %s: %w", r.Name, err)
+		}
+		e.rules = append(e.rules, &ruleState{
+			rule:   r,
+			filter: filter,
+			events: make(map[string][]model.Event),
+			fired:  make(map[string]time.Time),
+		})
+	}
+	return e, nil
+}
+
+// Observe counts event for matching rules and returns rules fired by it with their alerts
+func (e *Engine) Observe(ev model.Event) ([]config.AlertRule, []Alert) {
+	var (
+		rules  []config.AlertRule
+		alerts []Alert
+	)
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	now := ev.Time
+
+	for _, s := range e.rules {
+		if !s.filter.Match(ev) {
+			continue
+		}
+		if now.Sub(s.swept) >= s.rule.Window {
+			s.sweep(now)
+		}
+
+		group := ""
+		if s.rule.PerAcct {
+			group = ev.Acct
+		}
+
+		recent := append(s.within(group, now), ev)
+		s.events[group] = recent
+
+		if len(recent) <= s.rule.Threshold {
+			continue
+		}
+		if last, ok := s.fired[group]; ok && now.Sub(last) < s.rule.Cooldown {
+			continue
+		}
+		s.fired[group] = now
+
+		latest := recent
+		if len(latest) > maxAlertEvents {
+			latest = latest[len(latest)-maxAlertEvents:]
+		}
+		rules = append(rules, s.rule)
+		alerts = append(alerts, Alert{
+			Rule:      s.rule.Name,
+			Acct:      group,
+			Count:     len(recent),
+			Threshold: s.rule.Threshold,
+			Window:    s.rule.Window.String(),
+			First:     recent[0].Time,
+			Last:      now,
+			Events:    append([]model.Event{}, latest...),
+		})
+	}
+
+	return rules, alerts
+}
+
+// within drops events of group which left the window at now and returns the rest. Events come
+// in order, so the window starts after the last expired one.
+func (s *ruleState) within(group string, now time.Time) []model.Event {
+	events := s.events[group]
+	start := 0
+	for start < len(events) && now.Sub(events[start].Time) >= s.rule.Window {
+		start++
+	}
+	return events[start:]
+}
+
+// sweep forgets groups without events within the window and firings out of cooldown at now
+func (s *ruleState) sweep(now time.Time) {
+	for group := range s.events {
+		if recent := s.within(group, now); len(recent) > 0 {
+			s.events[group] = recent
+		} else {
+			delete(s.events, group)
+		}
+	}
+	for group, last := range s.fired {
+		if now.Sub(last) >= s.rule.Cooldown {
+			delete(s.fired, group)
+		}
+	}
+	s.swept = now
+}
+
+// Run executes hooks of the rule with the alert, command gets alert as JSON on standard input
+// and in GF_ALERT_* environment variables, URL gets it as JSON body
+func Run(rule config.AlertRule, a Alert, timeout time.Duration) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []string
+	if rule.Command != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", rule.Command)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Env = append(os.Environ(),
+			"GF_ALERT_RULE="+a.Rule,
+			"GF_ALERT_ACCT="+a.Acct,
+			"GF_ALERT_COUNT="+strconv.Itoa(a.Count),
+			"GF_ALERT_THRESHOLD="+strconv.Itoa(a.Threshold),
+			"GF_ALERT_WINDOW="+a.Window,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Sprintf("command failed: %s: %s", err, bytes.TrimSpace(out)))
+		}
+	}
+
+	if rule.URL != "" {
+		if err = post(ctx, rule.URL, payload); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// post sends alert to URL, any non-2xx status is a failure
+func post(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert url responded with status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package alert
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	e, err := NewEngine([]config.AlertRule{
+		{Name: "acct", Type: model.TopicLoginFailed, PerAcct: true, Threshold: 2, Window: time.Minute,
+			Cooldown: time.Hour, Command: "true"},
+		{Name: "all", Type: "login.*", Threshold: 3, Window: 10 * time.Second, URL: "http://localhost/alert"},
+	})
+	if err != nil {
+		t.Fatalf("Valid rules were rejected: %s", err)
+	}
+
+	start := time.Date(2023, 2, 1, 8, 0, 0, 0, time.UTC)
+	failure := func(acct string, after time.Duration) []config.AlertRule {
+		rules, _ := e.Observe(model.Event{Type: model.TopicLoginFailed, Acct: acct, Time: start.Add(after)})
+		return rules
+	}
+
+	// Per acct rule fires on the third failure of one acct, not on failures of other accts
+	if len(failure("jacky", 0)) != 0 || len(failure("jacky", time.Second)) != 0 || len(failure("roman", 2*time.Second)) != 0 {
+		t.Errorf("Rule fired before threshold was exceeded")
+	}
+	rules, alerts := e.Observe(model.Event{Type: model.TopicLoginFailed, Acct: "jacky", Time: start.Add(3 * time.Second)})
+	if len(rules) != 2 || rules[0].Name != "acct" || rules[1].Name != "all" {
+		t.Fatalf("Both rules should fire on the fourth failure, fired %v", rules)
+	}
+	if alerts[0].Acct != "jacky" || alerts[0].Count != 3 || alerts[1].Acct != "" || alerts[1].Count != 4 {
+		t.Errorf("Alerts have wrong context: %+v", alerts)
+	}
+
+	// Cool-down keeps per acct rule quiet, events out of window do not count for the other rule
+	if rules = failure("jacky", 4*time.Second); len(rules) != 1 || rules[0].Name != "all" {
+		t.Errorf("Rule in cool-down fired or rule without cool-down did not, fired %v", rules)
+	}
+	if rules = failure("roman", 30*time.Second); len(rules) != 0 {
+		t.Errorf("Events out of window were counted, fired %v", rules)
+	}
+
+	// Invalid rules are rejected
+	if _, err = NewEngine([]config.AlertRule{{Threshold: 1, Window: time.Minute}}); err == nil {
+		t.Errorf("Rule without command and url was accepted")
+	}
+}
+
+func TestObserveForgetsIdleAccts(t *testing.T) {
+	e, err := NewEngine([]config.AlertRule{
+		{Name: "acct", Type: model.TopicLoginFailed, PerAcct: true, Threshold: 1, Window: time.Minute,
+			Cooldown: 2 * time.Minute, Command: "true"},
+	})
+	if err != nil {
+		t.Fatalf("Valid rule was rejected: %s", err)
+	}
+	s := e.rules[0]
+
+	start := time.Date(2023, 2, 1, 8, 0, 0, 0, time.UTC)
+	failure := func(acct string, after time.Duration) {
+		e.Observe(model.Event{Type: model.TopicLoginFailed, Acct: acct, Time: start.Add(after)})
+	}
+
+	// Accts seen once each are kept within the window, jacky fires
+	for i := 0; i < 1000; i++ {
+		failure("user"+strconv.Itoa(i), time.Duration(i)*time.Millisecond)
+	}
+	failure("jacky", 2*time.Second)
+	failure("jacky", 3*time.Second)
+	if len(s.events) != 1001 || len(s.fired) != 1 {
+		t.Fatalf("Tracking %d accts with %d firings, want 1001 with 1", len(s.events), len(s.fired))
+	}
+
+	// Accts without events in the window are forgotten, the firing stays for its cooldown
+	failure("jacky", 90*time.Second)
+	if len(s.events) != 1 || len(s.events["jacky"]) != 1 || len(s.fired) != 1 {
+		t.Errorf("Tracking %d accts with %d firings after window, want 1 with 1", len(s.events), len(s.fired))
+	}
+	failure("roman", 4*time.Minute)
+	if len(s.events) != 1 || len(s.fired) != 0 {
+		t.Errorf("Tracking %d accts with %d firings after cooldown, want 1 with 0", len(s.events), len(s.fired))
+	}
+}
@@ -0,0 +1,185 @@
+// Provides propagation of events between replicas through Postgres NOTIFY and LISTEN.
+// Every replica sends its events to one channel and listens on it, so subscribers
+// connected to any replica see events of the whole cluster. Events are stored with the
+// notification, so a replica which lost its connection fetches the events it missed.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v5"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"gorm.io/gorm"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+const (
+	// idSequence numbers events of all replicas
+	idSequence = "event_ids"
+	// reconnectMax limits the pause between attempts to listen again
+	reconnectMax = 30 * time.Second
+	// backfillBatch is how many missed events are fetched at once
+	backfillBatch = 500
+)
+
+// Notifier is the cluster instance
+var Notifier *PgNotifier
+
+// InitNotifier creates the cluster instance, starts listening and joins the bus to the cluster
+func InitNotifier(db *gorm.DB, dsn, channel string, bus *eventbus.Bus) error {
+	Notifier = NewPgNotifier(db, dsn, channel, bus)
+	if err := Notifier.Start(); err != nil {
+		return err
+	}
+	bus.Join(Notifier)
+
+	return nil
+}
+
+// PgNotifier sends events with NOTIFY and delivers events received with LISTEN to the bus
+type PgNotifier struct {
+	db      *gorm.DB
+	dsn     string
+	channel string
+	lockKey int64
+	bus     *eventbus.Bus
+}
+
+// NewPgNotifier creates new notifier sending through db and listening on its own connection to dsn
+func NewPgNotifier(db *gorm.DB, dsn, channel string, bus *eventbus.Bus) *PgNotifier {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(channel))
+
+	return &PgNotifier{db: db, dsn: dsn, channel: channel, lockKey: int64(h.Sum64()), bus: bus}
+}
+
+// Send numbers event, stores it and notifies all replicas. Events are numbered and notified one at a time,
+// Postgres delivers notifications in commit order, so replicas receive them in ID order.
+func (n *PgNotifier) Send(e model.Event) (model.Event, error) {
+	err := n.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", n.lockKey).Error; err != nil {
+			return err
+		}
+		if err := tx.Raw("SELECT nextval('" + idSequence + "')").Scan(&e.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&e).Error; err != nil {
+			return err
+		}
+
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return tx.Exec("SELECT pg_notify(?, ?)", n.channel, string(payload)).Error
+	})
+	if err != nil {
+		return model.Event{}, err
+	}
+
+	return e, nil
+}
+
+// Start listens on the channel and delivers events to the bus in the background,
+// it listens again when the connection is lost and delivers events stored meanwhile
+func (n *PgNotifier) Start() error {
+	// Continue numbering after events this replica already knows, e.g. stored ones
+	if lastID := n.bus.LastID(); lastID > 0 {
+		if err := n.db.Exec("SELECT setval('"+idSequence+"', GREATEST((SELECT last_value FROM "+idSequence+"), ?))",
+			lastID).Error; err != nil {
+			return err
+		}
+	}
+
+	conn, err := n.listen()
+	if err != nil {
+		return err
+	}
+	if err = n.backfill(); err != nil {
+		_ = conn.Close(context.Background())
+		return err
+	}
+
+	go func() {
+		wait := time.Second
+		for {
+			if conn != nil {
+				n.receive(conn)
+				_ = conn.Close(context.Background())
+				wait = time.Second
+			}
+
+			time.Sleep(wait)
+			if conn, err = n.listen(); err != nil {
+				log.Println("Error listening to cluster events:", err)
+				if wait *= 2; wait > reconnectMax {
+					wait = reconnectMax
+				}
+				continue
+			}
+
+			// Events sent while the connection was lost are stored, those sent from now on are notified
+			if err = n.backfill(); err != nil {
+				log.Println("Error fetching missed cluster events:", err)
+				_ = conn.Close(context.Background())
+				conn = nil
+			}
+		}
+	}()
+
+	return nil
+}
+
+// listen opens connection and subscribes to the channel
+func (n *PgNotifier) listen() (*pgx.Conn, error) {
+	conn, err := pgx.Connect(context.Background(), n.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Exec(context.Background(), "LISTEN "+pgx.Identifier{n.channel}.Sanitize()); err != nil {
+		_ = conn.Close(context.Background())
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// receive delivers notifications to the bus until the connection fails
+func (n *PgNotifier) receive(conn *pgx.Conn) {
+	for {
+		notification, err := conn.WaitForNotification(context.Background())
+		if err != nil {
+			log.Println("Lost connection to cluster events, listening again:", err)
+			return
+		}
+
+		var e model.Event
+		if err = json.Unmarshal([]byte(notification.Payload), &e); err != nil {
+			log.Println("Error decoding cluster event:", err)
+			continue
+		}
+		n.bus.Deliver(e)
+	}
+}
+
+// backfill delivers stored events after the last one the bus knows, in ID order. Notifications
+// of the same events which arrive later are ignored by the bus.
+func (n *PgNotifier) backfill() error {
+	for {
+		var events []model.Event
+		if err := n.db.Where("id > ?", n.bus.LastID()).Order("id ASC").Limit(backfillBatch).
+			Find(&events).Error; err != nil {
+			return err
+		}
+		for _, e := range events {
+			n.bus.Deliver(e)
+		}
+		if len(events) < backfillBatch {
+			return nil
+		}
+	}
+}
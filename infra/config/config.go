@@ -1,5 +1,9 @@
 package config
 
+import (
+	"time"
+)
+
 type Config struct {
 	Web struct {
 		Listen     string
@@ -9,12 +13,137 @@ type Config struct {
 		Cert       string
 		JWTPrivKey string
 		JWTPubKey  string
+
+		// Largest request body handlers read, in bytes
+		MaxBodySize int64
+
+		// ConcealSignupConflict answers a signup for an existing acct like a successful one
+		ConcealSignupConflict bool
+
+		// Users listed on one page unless the client asks for another size, at most MaxPageSize
+		PageSize    int
+		MaxPageSize int
+
+		// Collation fullnames are sorted with, empty for the database default
+		SortCollation string
+
+		// Least word similarity from 0 to 1 of search text to acct or fullname of found users
+		SearchThreshold float64
+
+		// Patterns acct and fullname must match, and accts nobody can sign up with
+		AcctPattern     string
+		FullnamePattern string
+		ReservedAccts   []string
+
+		// How long responses to POST requests with Idempotency-Key are replayed for retries,
+		// and how long a request in progress holds its key before a retry may take it over
+		IdempotencyWindow time.Duration
+		IdempotencyLease  time.Duration
+
+		// ValidateRequests checks v1 requests against the OpenAPI document before handlers
+		ValidateRequests bool
+
+		// Websocket client buffer size and what to do with clients which cannot keep up
+		WSBufferSize         int
+		WSSlowConsumerPolicy string
+
+		// Roles allowed to subscribe to websocket routes and origins allowed to connect
+		WSAllowedRoles   []string
+		WSAllowedOrigins []string
+
+		// Websocket keepalive on server and client: ping interval, how long to wait for pong,
+		// deadline of one write and the largest message to read
+		WSPingInterval   time.Duration
+		WSPongWait       time.Duration
+		WSWriteWait      time.Duration
+		WSMaxMessageSize int64
+
+		// Whether websocket messages may be compressed with permessage-deflate
+		WSCompression bool
+
+		// Acct is locked for LockoutDuration after LockoutThreshold failed logins within LockoutWindow,
+		// zero threshold disables the lockout
+		LockoutThreshold int
+		LockoutWindow    time.Duration
+		LockoutDuration  time.Duration
+
+		// Number of recent events kept for replay and whether to store all events in Postgres
+		EventHistorySize int
+		PersistEvents    bool
+
+		// Whether replicas exchange events through Postgres NOTIFY and LISTEN, and on which channel
+		ClusterEvents  bool
+		ClusterChannel string
+
+		// How often the outbox is polled for events and how many are published at once
+		OutboxInterval  time.Duration
+		OutboxBatchSize int
+
+		// Interval of heartbeat comments on idle Server-Sent Events stream
+		SSEHeartbeat time.Duration
+
+		// Webhook delivery workers, attempts per event, back-off before the first retry
+		// and timeout of one attempt
+		WebhookWorkers     int
+		WebhookMaxAttempts int
+		WebhookBackoff     time.Duration
+		WebhookTimeout     time.Duration
+	}
+	WSClient struct {
+		Token     string
+		StateFile string
+
+		// Service acct logging in for fresh token before every connection instead of Token
+		LoginAcct string
+		LoginPwd  string
+
+		// Failed attempts to reconnect before giving up, zero retries forever,
+		// and bounds of exponential back-off between them
+		MaxRetries   int
+		ReconnectMin time.Duration
+		ReconnectMax time.Duration
+
+		// Output format, event filters and outputs with their settings
+		Format         string
+		Acct           string
+		Types          string
+		Sinks          []string
+		File           string
+		FileMaxSize    int64
+		FileMaxBackups int
+		SyslogTag      string
+
+		// Exit after Count events or after Timeout, zero values run forever
+		Count   int
+		Timeout time.Duration
+
+		// Encoding of events on the websocket, subprotocol of one of eventcodec encodings
+		Encoding string
+
+		// Threshold alerts and how long their hooks may run
+		Alerts       []AlertRule
+		AlertTimeout time.Duration
 	}
 	Database struct {
 		PostgresURI string
 	}
 }
 
+// AlertRule fires when more than Threshold events of Type and Acct pattern arrive within Window,
+// counted for every acct alone when PerAcct is set. It runs Command, posts to URL or both,
+// then stays quiet for Cooldown.
+type AlertRule struct {
+	Name      string        `mapstructure:"name"`
+	Type      string        `mapstructure:"type"`
+	Acct      string        `mapstructure:"acct"`
+	PerAcct   bool          `mapstructure:"per_acct"`
+	Threshold int           `mapstructure:"threshold"`
+	Window    time.Duration `mapstructure:"window"`
+	Cooldown  time.Duration `mapstructure:"cooldown"`
+	Command   string        `mapstructure:"command"`
+	URL       string        `mapstructure:"url"`
+}
+
 var (
 	Cfg Config
 )
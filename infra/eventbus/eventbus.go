@@ -0,0 +1,289 @@
+// Provides in-process event bus for user lifecycle and login events.
+// Subscribers choose events by topics and acct, each gets them through its own bounded buffer.
+// Every event gets monotonically increasing ID, recent events are kept for replay.
+// Replicas joined in a cluster exchange events, so subscribers see events of all of them.
+
+package eventbus
+
+import (
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/hub"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events is the bus instance
+var Events *Bus
+
+const (
+	// maxStoredReplay limits how many events one subscriber can replay from the store
+	maxStoredReplay = 10000
+	// saveQueueSize is how many events can wait to be saved to the store
+	saveQueueSize = 1024
+)
+
+// InitEvents creates the bus instance
+func InitEvents(bufSize int, policy hub.Policy, historySize int) {
+	Events = NewBus(bufSize, policy, historySize)
+}
+
+// Filter selects events for a subscriber. Topic "user.*" matches all topics with the prefix,
+// acct is a glob pattern. Empty filter matches all events.
+type Filter struct {
+	Topics []string
+	Acct   string
+}
+
+// ErrBadAcctPattern occurs when acct pattern of the filter is malformed
+var ErrBadAcctPattern = errors.New("acct filter is not valid glob pattern")
+
+// ParseFilter creates filter from comma separated topics and acct pattern
+func ParseFilter(topics, acct string) (Filter, error) {
+	var f Filter
+	for _, t := range strings.Split(topics, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.Topics = append(f.Topics, t)
+		}
+	}
+
+	if _, err := path.Match(acct, ""); err != nil {
+		return Filter{}, ErrBadAcctPattern
+	}
+	f.Acct = acct
+
+	return f, nil
+}
+
+// Match checks event against topics and acct pattern of the filter
+func (f Filter) Match(e model.Event) bool {
+	if f.Acct != "" {
+		if ok, _ := path.Match(f.Acct, e.Acct); !ok {
+			return false
+		}
+	}
+
+	if len(f.Topics) == 0 {
+		return true
+	}
+	for _, t := range f.Topics {
+		if t == "*" || t == e.Type ||
+			strings.HasSuffix(t, ".*") && strings.HasPrefix(e.Type, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cluster carries events to all replicas, including the sending one. Send assigns cluster-wide
+// increasing ID to the event and stores it, replicas receive events in ID order and hand them to Deliver.
+type Cluster interface {
+	Send(e model.Event) (model.Event, error)
+}
+
+// Subscription delivers matching events to one subscriber
+type Subscription = hub.Client[model.Event]
+
+// Bus publishes events to all matching subscriptions and keeps recent events for replay
+type Bus struct {
+	mu      sync.Mutex
+	hub     *hub.Hub[model.Event]
+	lastID  uint64
+	history []model.Event // ring buffer of recent events
+	next    int           // history position for the next event
+	store   repository.EventRepository
+	saves   chan model.Event
+	cluster Cluster
+}
+
+// NewBus creates new bus with per-subscriber buffer size, slow consumer policy
+// and number of recent events kept for replay
+func NewBus(bufSize int, policy hub.Policy, historySize int) *Bus {
+	if historySize < 1 {
+		historySize = 1
+	}
+	return &Bus{
+		hub:     hub.NewHub[model.Event](bufSize, policy),
+		history: make([]model.Event, 0, historySize),
+	}
+}
+
+// Persist saves all published events to the store, so they can be replayed
+// beyond the recent events and event IDs keep growing after restart
+func (b *Bus) Persist(store repository.EventRepository) error {
+	lastID, err := store.LastID()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastID > b.lastID {
+		b.lastID = lastID
+	}
+	b.store = store
+	b.saves = make(chan model.Event, saveQueueSize)
+
+	// Save in the background in publishing order, so publishers never wait for the database
+	go func() {
+		for e := range b.saves {
+			if err := store.Save(e); err != nil {
+				log.Printf("Error saving event %d: %s", e.ID, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Join makes the bus publish events through the cluster instead of delivering them at once
+func (b *Bus) Join(c Cluster) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cluster = c
+}
+
+// LastID returns ID of the last published or delivered event
+func (b *Bus) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lastID
+}
+
+// Publish assigns next ID to event and sends it to matching subscribers without blocking,
+// it returns the numbered event. In a cluster, the event is numbered and stored by the cluster,
+// sent to all replicas and delivered when it comes back. Publishing fails only in a cluster.
+func (b *Bus) Publish(e model.Event) (model.Event, error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	cluster := b.cluster
+	if cluster == nil {
+		b.lastID++
+		e.ID = b.lastID
+		b.deliver(e)
+		b.saveLocked(e)
+		b.mu.Unlock()
+
+		return e, nil
+	}
+	b.mu.Unlock()
+
+	return cluster.Send(e)
+}
+
+// Deliver sends event received from the cluster with its ID to matching subscribers.
+// Events already delivered are ignored.
+func (b *Bus) Deliver(e model.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e.ID <= b.lastID {
+		return
+	}
+	b.lastID = e.ID
+	b.deliver(e)
+}
+
+// deliver remembers event and broadcasts it, caller must hold the lock
+func (b *Bus) deliver(e model.Event) {
+	// Remember the event, overwriting the oldest one when history is full
+	if len(b.history) < cap(b.history) {
+		b.history = append(b.history, e)
+	} else {
+		b.history[b.next] = e
+	}
+	b.next = (b.next + 1) % cap(b.history)
+
+	b.hub.Broadcast(e)
+}
+
+// saveLocked queues event for the store, caller must hold the lock
+func (b *Bus) saveLocked(e model.Event) {
+	if b.saves != nil {
+		select {
+		case b.saves <- e:
+		default:
+			log.Printf("Event store cannot keep up, event %d not saved", e.ID)
+		}
+	}
+}
+
+// Subscribe registers new subscription for events matching the filter
+func (b *Bus) Subscribe(f Filter) *Subscription {
+	return b.hub.Register(f.Match)
+}
+
+// SubscribeSince registers new subscription like Subscribe and returns events matching
+// the filter published after event since. Those should be delivered before the live ones.
+// At most maxStoredReplay of the newest events older than the history come from the store.
+func (b *Bus) SubscribeSince(f Filter, since uint64) (*Subscription, []model.Event, error) {
+	var missed []model.Event
+	replayed := 0
+
+	for {
+		b.mu.Lock()
+		oldest, store := b.oldestID(), b.store
+
+		// Take events from history and subscribe at once, so no event falls in between
+		if store == nil || since+1 >= oldest {
+			for i := 0; i < len(b.history); i++ {
+				e := b.history[(b.next+i)%len(b.history)]
+				if e.ID > since && f.Match(e) {
+					missed = append(missed, e)
+				}
+			}
+			sub := b.hub.Register(f.Match)
+			b.mu.Unlock()
+
+			return sub, missed, nil
+		}
+		b.mu.Unlock()
+
+		// Events older than the history come from the store without holding the lock. Events which
+		// leave the history meanwhile are fetched in the next round, before the history is taken.
+		limit := oldest - since - 1
+		if budget := uint64(maxStoredReplay - replayed); limit > budget {
+			since = oldest - 1 - budget
+			limit = budget
+		}
+		if limit > 0 {
+			stored, err := store.Since(since, int(limit))
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, e := range stored {
+				if e.ID < oldest && f.Match(e) {
+					missed = append(missed, e)
+				}
+			}
+			replayed += int(limit)
+		}
+		since = oldest - 1
+	}
+}
+
+// Unsubscribe removes subscription from the bus
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.hub.Unregister(s)
+}
+
+// oldestID returns ID of the oldest event in history, caller must hold the lock
+func (b *Bus) oldestID() uint64 {
+	if len(b.history) == 0 {
+		return b.lastID + 1
+	}
+	if len(b.history) < cap(b.history) {
+		return b.history[0].ID
+	}
+	return b.history[b.next].ID
+}
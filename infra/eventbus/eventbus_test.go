@@ -0,0 +1,244 @@
+package eventbus
+
+import (
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/hub"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFilterMatch(t *testing.T) {
+	e := model.Event{Type: model.TopicLoginFailed, Acct: "jacky_yang"}
+
+	cases := []struct {
+		topics, acct string
+		match        bool
+	}{
+		{"", "", true},
+		{"login.failed", "", true},
+		{"user.created, login.failed", "", true},
+		{"login.*", "jacky*", true},
+		{"*", "jacky_yang", true},
+		{"user.*", "", false},
+		{"login.failed", "roman*", false},
+		{"login", "", false},
+	}
+	for _, c := range cases {
+		f, err := ParseFilter(c.topics, c.acct)
+		if err != nil || f.Match(e) != c.match {
+			t.Errorf("Filter topics %q acct %q should match %v", c.topics, c.acct, c.match)
+		}
+	}
+
+	// Malformed acct pattern is rejected
+	if _, err := ParseFilter("", "jacky["); err == nil {
+		t.Errorf("Malformed acct pattern was accepted")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	b := NewBus(4, hub.DropMessage, 10)
+	failures := b.Subscribe(Filter{Topics: []string{model.TopicLoginFailed}})
+	all := b.Subscribe(Filter{})
+
+	b.Publish(model.Event{Type: model.TopicUserCreated, Acct: "jacky_yang"})
+	b.Publish(model.Event{Type: model.TopicLoginFailed, Acct: "jacky_yang"})
+
+	if e := <-failures.Messages(); e.Type != model.TopicLoginFailed || e.Time.IsZero() {
+		t.Errorf("Login failures subscriber received %+v", e)
+	}
+	if len(all.Messages()) != 2 {
+		t.Errorf("Subscriber without filter did not receive all events")
+	}
+}
+
+// memStore keeps events in memory for tests
+type memStore struct {
+	mu     sync.Mutex
+	events []model.Event
+}
+
+func (m *memStore) Save(e model.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *memStore) Since(id uint64, limit int) ([]model.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []model.Event
+	for _, e := range m.events {
+		if e.ID > id && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *memStore) LastID() (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.events) == 0 {
+		return 0, nil
+	}
+	return m.events[len(m.events)-1].ID, nil
+}
+
+func TestSubscribeSince(t *testing.T) {
+
+	// Events older than history of 3 events come from the store, IDs continue after the stored ones
+	store := &memStore{}
+	for id := uint64(1); id <= 7; id++ {
+		store.events = append(store.events, model.Event{ID: id, Type: model.TopicLoginFailed})
+	}
+	b := NewBus(4, hub.DropMessage, 3)
+	if err := b.Persist(store); err != nil {
+		t.Fatalf("Persist failed: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		b.Publish(model.Event{Type: model.TopicLoginFailed})
+	}
+
+	sub, missed, err := b.SubscribeSince(Filter{}, 4)
+	if err != nil {
+		t.Fatalf("SubscribeSince failed: %s", err)
+	}
+	if len(missed) != 6 {
+		t.Fatalf("Replayed %d events instead of 6", len(missed))
+	}
+	for i, e := range missed {
+		if e.ID != uint64(i+5) {
+			t.Errorf("Replayed event %d has ID %d instead of %d", i, e.ID, i+5)
+		}
+	}
+
+	// Live events continue after the replayed ones
+	b.Publish(model.Event{Type: model.TopicUserCreated})
+	if e := <-sub.Messages(); e.ID != 11 {
+		t.Errorf("Live event has ID %d instead of 11", e.ID)
+	}
+
+	// Nothing is replayed for up-to-date subscriber
+	if _, missed, _ = b.SubscribeSince(Filter{}, 11); len(missed) != 0 {
+		t.Errorf("Up-to-date subscriber got %d replayed events", len(missed))
+	}
+}
+
+// racingStore runs publish during the first query, like events published while the store is queried
+type racingStore struct {
+	*memStore
+	publish func()
+}
+
+func (r *racingStore) Since(id uint64, limit int) ([]model.Event, error) {
+	if publish := r.publish; publish != nil {
+		r.publish = nil
+		publish()
+	}
+	return r.memStore.Since(id, limit)
+}
+
+func TestSubscribeSinceWhileHistoryMoves(t *testing.T) {
+	store := &racingStore{memStore: &memStore{}}
+	for id := uint64(1); id <= 5; id++ {
+		store.events = append(store.events, model.Event{ID: id, Type: model.TopicLoginFailed})
+	}
+	b := NewBus(16, hub.DropMessage, 3)
+	if err := b.Persist(store); err != nil {
+		t.Fatalf("Persist failed: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		b.Publish(model.Event{Type: model.TopicLoginFailed})
+	}
+
+	// Events 6 to 8 leave the history of 3 events while older events are queried
+	store.publish = func() {
+		for i := 0; i < 4; i++ {
+			b.Publish(model.Event{Type: model.TopicLoginFailed})
+		}
+		for {
+			if last, _ := store.LastID(); last == 12 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	_, missed, err := b.SubscribeSince(Filter{}, 2)
+	if err != nil {
+		t.Fatalf("SubscribeSince failed: %s", err)
+	}
+	if len(missed) != 10 {
+		t.Fatalf("Replayed %d events instead of 10", len(missed))
+	}
+	for i, e := range missed {
+		if e.ID != uint64(i+3) {
+			t.Errorf("Replayed event %d has ID %d instead of %d", i, e.ID, i+3)
+		}
+	}
+}
+
+// loopCluster numbers events and hands them back to the bus like a cluster of one replica,
+// failing the first send
+type loopCluster struct {
+	bus    *Bus
+	lastID uint64
+	failed bool
+}
+
+func (c *loopCluster) Send(e model.Event) (model.Event, error) {
+	if !c.failed {
+		c.failed = true
+		return model.Event{}, errors.New("connection lost")
+	}
+	c.lastID += 10
+	e.ID = c.lastID
+	c.bus.Deliver(e)
+	return e, nil
+}
+
+func TestJoin(t *testing.T) {
+	b := NewBus(4, hub.DropMessage, 10)
+	store := &memStore{}
+	if err := b.Persist(store); err != nil {
+		t.Fatalf("Persist failed: %s", err)
+	}
+	b.Join(&loopCluster{bus: b})
+	sub := b.Subscribe(Filter{})
+
+	// Failed send is reported to the publisher, which publishes again
+	if _, err := b.Publish(model.Event{Type: model.TopicUserCreated, Acct: "jacky_yang"}); err == nil {
+		t.Errorf("Failed send was not reported")
+	}
+	if e, err := b.Publish(model.Event{Type: model.TopicUserCreated, Acct: "jacky_yang"}); err != nil || e.ID != 10 {
+		t.Errorf("Published event has ID %d, error %v", e.ID, err)
+	}
+	if _, err := b.Publish(model.Event{Type: model.TopicUserDeleted, Acct: "jacky_yang"}); err != nil {
+		t.Errorf("Publish failed: %s", err)
+	}
+
+	// Events come back with cluster IDs in order
+	for _, want := range []uint64{10, 20} {
+		select {
+		case e := <-sub.Messages():
+			if e.ID != want {
+				t.Errorf("Event has ID %d, want %d", e.ID, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %d was not delivered", want)
+		}
+	}
+
+	// Events delivered again are ignored, the cluster stores events instead of the bus
+	b.Deliver(model.Event{ID: 20, Type: model.TopicUserDeleted})
+	if len(sub.Messages()) != 0 || b.LastID() != 20 {
+		t.Errorf("Event delivered twice reached subscriber")
+	}
+	if last, _ := store.LastID(); last != 0 {
+		t.Errorf("Bus stored event %d sent through the cluster", last)
+	}
+}
@@ -0,0 +1,84 @@
+// Provides encodings of events on the websocket, negotiated through Sec-WebSocket-Protocol:
+// JSON (the default), MessagePack and Protocol Buffers described by event.proto.
+
+package eventcodec
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+)
+
+// Subprotocols of the encodings
+const (
+	JSON        = "events.json"
+	MessagePack = "events.msgpack"
+	Protobuf    = "events.protobuf"
+)
+
+// Encodings lists supported encodings in order of preference, when the client does not prefer any
+var Encodings = []string{JSON, MessagePack, Protobuf}
+
+// ErrUnknownEncoding occurs when encoding is not one of the supported ones
+var ErrUnknownEncoding = errors.New("unknown encoding, should be json, msgpack or protobuf")
+
+// ErrMalformed occurs when encoded event cannot be decoded
+var ErrMalformed = errors.New("malformed encoded event")
+
+// Negotiate picks the first offered subprotocol which is a supported encoding, empty if there is none
+func Negotiate(offered []string) string {
+	for _, p := range offered {
+		for _, enc := range Encodings {
+			if p == enc {
+				return enc
+			}
+		}
+	}
+	return ""
+}
+
+// Parse resolves short encoding name like msgpack to its subprotocol
+func Parse(name string) (string, error) {
+	switch name {
+	case "json", "", JSON:
+		return JSON, nil
+	case "msgpack", MessagePack:
+		return MessagePack, nil
+	case "protobuf", Protobuf:
+		return Protobuf, nil
+	}
+	return "", ErrUnknownEncoding
+}
+
+// Binary reports whether encoded events should be sent as binary messages
+func Binary(encoding string) bool {
+	return encoding == MessagePack || encoding == Protobuf
+}
+
+// Marshal encodes event, empty encoding means JSON
+func Marshal(encoding string, e model.Event) ([]byte, error) {
+	switch encoding {
+	case JSON, "":
+		return json.Marshal(e)
+	case MessagePack:
+		return marshalMsgpack(e), nil
+	case Protobuf:
+		return marshalProtobuf(e), nil
+	}
+	return nil, ErrUnknownEncoding
+}
+
+// Unmarshal decodes event, empty encoding means JSON
+func Unmarshal(encoding string, data []byte) (model.Event, error) {
+	switch encoding {
+	case JSON, "":
+		var e model.Event
+		err := json.Unmarshal(data, &e)
+		return e, err
+	case MessagePack:
+		return unmarshalMsgpack(data)
+	case Protobuf:
+		return unmarshalProtobuf(data)
+	}
+	return model.Event{}, ErrUnknownEncoding
+}
@@ -0,0 +1,167 @@
+package eventcodec
+
+import (
+	"bytes"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	events := []model.Event{
+		{ID: 7, Type: model.TopicLoginFailed, Acct: "jacky_yang",
+			Time: time.Date(2023, 2, 1, 8, 30, 0, 123456789, time.UTC), Detail: "Password incorrect"},
+		{ID: 1 << 40, Type: model.TopicUserCreated, Acct: "roman", Time: time.Unix(1675240200, 0).UTC()},
+		{ID: 300, Type: model.TopicUserUpdated, Acct: strings.Repeat("a", 50),
+			Time: time.Unix(1675240200, 0).UTC(), Detail: strings.Repeat("long detail ", 30)},
+	}
+
+	for _, enc := range Encodings {
+		for _, e := range events {
+			data, err := Marshal(enc, e)
+			if err != nil {
+				t.Fatalf("%s: Marshal failed: %s", enc, err)
+			}
+			got, err := Unmarshal(enc, data)
+			if err != nil {
+				t.Fatalf("%s: Unmarshal failed: %s", enc, err)
+			}
+			if got.ID != e.ID || got.Type != e.Type || got.Acct != e.Acct || got.Detail != e.Detail ||
+				!got.Time.Equal(e.Time) {
+				t.Errorf("%s: Event %+v came back as %+v", enc, e, got)
+			}
+		}
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	e := model.Event{ID: 150, Type: "a", Acct: "b", Time: time.Unix(1, 2)}
+
+	// Protocol Buffers bytes as protoc generated code writes them
+	want := []byte{0x08, 0x96, 0x01, 0x12, 0x01, 'a', 0x1a, 0x01, 'b', 0x22, 0x04, 0x08, 0x01, 0x10, 0x02}
+	if got, _ := Marshal(Protobuf, e); !bytes.Equal(got, want) {
+		t.Errorf("Protobuf encoding is % x, want % x", got, want)
+	}
+
+	// MessagePack timestamp in 32-bit form from other encoders is understood
+	data := []byte{0x82, 0xa2, 'i', 'd', 0xcc, 150, 0xa4, 't', 'i', 'm', 'e', 0xd6, 0xff, 0, 0, 0, 1}
+	got, err := Unmarshal(MessagePack, data)
+	if err != nil || got.ID != 150 || got.Time.Unix() != 1 {
+		t.Errorf("MessagePack event decoded as %+v, %v", got, err)
+	}
+
+	// Truncated messages are rejected
+	for _, enc := range []string{MessagePack, Protobuf} {
+		data, _ := Marshal(enc, e)
+		if _, err = Unmarshal(enc, data[:len(data)-2]); err == nil {
+			t.Errorf("%s: Truncated event was decoded", enc)
+		}
+	}
+}
+
+// TestSpecVectors decodes bytes written as the MessagePack and Protocol Buffers specifications
+// allow other encoders to write them
+func TestSpecVectors(t *testing.T) {
+	// msgpackEvent is map of id and time, preceded by other entries
+	msgpackEvent := func(id []byte, entries ...[]byte) []byte {
+		b := []byte{0xde, 0, byte(2 + len(entries))}
+		for _, entry := range entries {
+			b = append(b, entry...)
+		}
+		b = append(append(b, 0xa2, 'i', 'd'), id...)
+		return append(b, 0xa4, 't', 'i', 'm', 'e', 0xd6, 0xff, 0, 0, 0, 1)
+	}
+
+	msgpackTests := []struct {
+		name string
+		data []byte
+		id   uint64
+		time time.Time
+		ok   bool
+	}{
+		{"int 8 id", msgpackEvent([]byte{0xd0, 0x05}), 5, time.Unix(1, 0), true},
+		{"int 16 id", msgpackEvent([]byte{0xd1, 0x01, 0x2c}), 300, time.Unix(1, 0), true},
+		{"int 32 id", msgpackEvent([]byte{0xd2, 0, 0x01, 0, 0}), 1 << 16, time.Unix(1, 0), true},
+		{"int 64 id", msgpackEvent([]byte{0xd3, 0, 0, 0x01, 0, 0, 0, 0, 0}), 1 << 40, time.Unix(1, 0), true},
+		{"uint 64 id", msgpackEvent([]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}),
+			1<<64 - 1, time.Unix(1, 0), true},
+		{"negative fixint id", msgpackEvent([]byte{0xff}), 0, time.Time{}, false},
+		{"negative int 8 id", msgpackEvent([]byte{0xd0, 0xff}), 0, time.Time{}, false},
+		{"negative int 64 id", msgpackEvent([]byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}), 0, time.Time{}, false},
+		{"string id", msgpackEvent([]byte{0xa1, '1'}), 0, time.Time{}, false},
+		{"unknown keys", msgpackEvent([]byte{0x07},
+			[]byte{0xa4, 't', 'a', 'g', 's', 0x92, 0x01, 0xa1, 'x'},
+			[]byte{0xa4, 'm', 'e', 't', 'a', 0xdf, 0, 0, 0, 0x01, 0xa1, 'a', 0x91, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+			[]byte{0xa5, 'r', 'a', 't', 'i', 'o', 0xca, 0x3f, 0xc0, 0, 0},
+			[]byte{0xa3, 'r', 'a', 'w', 0xc4, 0x02, 0x01, 0x02},
+			[]byte{0xa3, 'e', 'x', 't', 0xd4, 0x01, 0},
+			[]byte{0xa4, 'l', 'o', 'n', 'g', 0xc8, 0, 0x02, 0x01, 0, 0},
+			[]byte{0x01, 0xc3}), 7, time.Unix(1, 0), true},
+		{"nested value cut short", msgpackEvent([]byte{0x07}, []byte{0xa1, 'x', 0xdd, 0, 0, 0x01, 0}),
+			0, time.Time{}, false},
+		{"timestamp 64", []byte{0x81, 0xa4, 't', 'i', 'm', 'e', 0xd7, 0xff, 0, 0, 0, 0x08, 0, 0, 0, 0x01},
+			0, time.Unix(1, 2), true},
+		{"timestamp 96", []byte{0x81, 0xa4, 't', 'i', 'm', 'e', 0xc7, 0x0c, 0xff, 0, 0, 0, 0x02,
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 0, time.Unix(-1, 2), true},
+		{"timestamp 96 with too many nanoseconds", []byte{0x81, 0xa4, 't', 'i', 'm', 'e', 0xc7, 0x0c, 0xff,
+			0x3b, 0x9a, 0xca, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}, 0, time.Time{}, false},
+	}
+	for _, tt := range msgpackTests {
+		got, err := Unmarshal(MessagePack, tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("MessagePack %s: Unmarshal returned %v", tt.name, err)
+			continue
+		}
+		if tt.ok && (got.ID != tt.id || !got.Time.Equal(tt.time)) {
+			t.Errorf("MessagePack %s: decoded as %+v", tt.name, got)
+		}
+	}
+
+	protobufTests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"unknown fields of every wire type", []byte{0x08, 0x96, 0x01,
+			0x31, 1, 2, 3, 4, 5, 6, 7, 8, // field 6, fixed64
+			0x3d, 1, 2, 3, 4, // field 7, fixed32
+			0x42, 0x01, 'z', // field 8, length-delimited
+			0x48, 0x01, // field 9, varint
+			0x12, 0x01, 'a'}, true},
+		{"id as length-delimited", []byte{0x0a, 0x01, 'x'}, false},
+		{"type as varint", []byte{0x10, 0x01}, false},
+		{"time as fixed64", []byte{0x21, 1, 2, 3, 4, 5, 6, 7, 8}, false},
+		{"negative nanoseconds", []byte{0x22, 0x0b, 0x10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			false},
+		{"unknown wire type", []byte{0x0b}, false},
+	}
+	for _, tt := range protobufTests {
+		got, err := Unmarshal(Protobuf, tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("Protobuf %s: Unmarshal returned %v", tt.name, err)
+		}
+		if tt.ok && (got.ID != 150 || got.Type != "a") {
+			t.Errorf("Protobuf %s: decoded as %+v", tt.name, got)
+		}
+	}
+
+	// Timestamp before 1970 has negative seconds as ten-byte varint
+	data := []byte{0x22, 0x0d, 0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x10, 0x02}
+	if got, err := Unmarshal(Protobuf, data); err != nil || !got.Time.Equal(time.Unix(-1, 2)) {
+		t.Errorf("Protobuf time decoded as %v, %v", got.Time, err)
+	}
+	e := model.Event{Time: time.Unix(-1, 2)}
+	if got, _ := Marshal(Protobuf, e); !bytes.Equal(got, data) {
+		t.Errorf("Protobuf encoding of time is % x, want % x", got, data)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	if enc := Negotiate([]string{"bearer.token", MessagePack, Protobuf}); enc != MessagePack {
+		t.Errorf("Negotiated %q, want the first supported offer", enc)
+	}
+	if enc := Negotiate([]string{"bearer.token"}); enc != "" {
+		t.Errorf("Negotiated %q without supported offer", enc)
+	}
+}
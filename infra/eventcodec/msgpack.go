@@ -0,0 +1,261 @@
+package eventcodec
+
+import (
+	"encoding/binary"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"math"
+	"time"
+)
+
+// marshalMsgpack encodes event as MessagePack map with the same keys as JSON,
+// time is the standard timestamp extension
+func marshalMsgpack(e model.Event) []byte {
+	size := 4
+	if e.Detail != "" {
+		size++
+	}
+
+	b := []byte{0x80 | byte(size)}
+	b = appendMsgpackString(b, "id")
+	b = appendMsgpackUint(b, e.ID)
+	b = appendMsgpackString(b, "type")
+	b = appendMsgpackString(b, e.Type)
+	b = appendMsgpackString(b, "acct")
+	b = appendMsgpackString(b, e.Acct)
+	b = appendMsgpackString(b, "time")
+	b = append(b, 0xc7, 12, 0xff) // ext 8 of type -1 with 96-bit timestamp
+	b = binary.BigEndian.AppendUint32(b, uint32(e.Time.Nanosecond()))
+	b = binary.BigEndian.AppendUint64(b, uint64(e.Time.Unix()))
+	if e.Detail != "" {
+		b = appendMsgpackString(b, "detail")
+		b = appendMsgpackString(b, e.Detail)
+	}
+	return b
+}
+
+func appendMsgpackUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// msgpackReader decodes the MessagePack values events are made of
+type msgpackReader struct {
+	data []byte
+	err  error
+}
+
+// take returns next n bytes, or nil when there are not enough
+func (r *msgpackReader) take(n int) []byte {
+	if r.err != nil || n < 0 || len(r.data) < n {
+		r.err = ErrMalformed
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// length reads big-endian length of size bytes
+func (r *msgpackReader) length(size int) int {
+	b := r.take(size)
+	if b == nil {
+		return 0
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	if n > uint64(len(r.data)) {
+		r.err = ErrMalformed
+		return 0
+	}
+	return int(n)
+}
+
+// value reads one value, which is string, uint64 for positive and int64 for negative integers,
+// float64, []byte, time.Time, bool, nil, extension or number of entries of a map or array.
+// Other encoders may write positive integers in signed formats, they are read as uint64 too.
+func (r *msgpackReader) value() interface{} {
+	b := r.take(1)
+	if b == nil {
+		return nil
+	}
+
+	switch c := b[0]; {
+	case c < 0x80:
+		return uint64(c)
+	case c >= 0xe0:
+		return int64(int8(c))
+	case c&0xf0 == 0x80:
+		return mapLen(c & 0x0f)
+	case c&0xf0 == 0x90:
+		return arrayLen(c & 0x0f)
+	case c&0xe0 == 0xa0:
+		return string(r.take(int(c & 0x1f)))
+	}
+
+	switch b[0] {
+	case 0xc0:
+		return nil
+	case 0xc2:
+		return false
+	case 0xc3:
+		return true
+	case 0xc4, 0xc5, 0xc6:
+		return r.take(r.length(1 << (b[0] - 0xc4)))
+	case 0xc7, 0xc8, 0xc9:
+		n := r.length(1 << (b[0] - 0xc7))
+		return r.extension(r.take(1), r.take(n))
+	case 0xca:
+		return float64(math.Float32frombits(uint32(r.unsigned(4))))
+	case 0xcb:
+		return math.Float64frombits(r.unsigned(8))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		size := 1 << (b[0] - 0xcc)
+		return r.unsigned(size)
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b[0] - 0xd0)
+		v := r.unsigned(size)
+		shift := 64 - 8*size
+		if signed := int64(v<<shift) >> shift; signed < 0 {
+			return signed
+		}
+		return v
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return r.extension(r.take(1), r.take(1<<(b[0]-0xd4)))
+	case 0xd9, 0xda, 0xdb:
+		return string(r.take(r.length(1 << (b[0] - 0xd9))))
+	case 0xdc, 0xdd:
+		return arrayLen(r.unsigned(2 << (b[0] - 0xdc)))
+	case 0xde, 0xdf:
+		return mapLen(r.unsigned(2 << (b[0] - 0xde)))
+	}
+
+	r.err = ErrMalformed
+	return nil
+}
+
+// mapLen is number of entries of a map
+type mapLen uint64
+
+// arrayLen is number of items of an array
+type arrayLen uint64
+
+// extension is value of extension type other than timestamp
+type extension struct{}
+
+// skip reads over entries of map or items of array v, also nested ones
+func (r *msgpackReader) skip(v interface{}) {
+	var n uint64
+	switch v := v.(type) {
+	case mapLen:
+		n = 2 * uint64(v)
+	case arrayLen:
+		n = uint64(v)
+	}
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		r.skip(r.value())
+	}
+}
+
+func (r *msgpackReader) unsigned(size int) uint64 {
+	var v uint64
+	for _, c := range r.take(size) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// extension decodes timestamp extension and reads over others
+func (r *msgpackReader) extension(extType, data []byte) interface{} {
+	if r.err != nil || len(extType) != 1 {
+		r.err = ErrMalformed
+		return nil
+	}
+	if extType[0] != 0xff {
+		return extension{}
+	}
+	return r.timestamp(data)
+}
+
+// timestamp decodes timestamp extension in its 32, 64 or 96-bit form
+func (r *msgpackReader) timestamp(data []byte) interface{} {
+	switch len(data) {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC()
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		if v>>34 < 1e9 {
+			return time.Unix(int64(v&(1<<34-1)), int64(v>>34)).UTC()
+		}
+	case 12:
+		if nsec := binary.BigEndian.Uint32(data[:4]); nsec < 1e9 {
+			return time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(nsec)).UTC()
+		}
+	}
+	r.err = ErrMalformed
+	return nil
+}
+
+// unmarshalMsgpack decodes event map, unknown keys are skipped
+func unmarshalMsgpack(data []byte) (model.Event, error) {
+	var e model.Event
+
+	r := &msgpackReader{data: data}
+	size, ok := r.value().(mapLen)
+	if !ok {
+		return model.Event{}, ErrMalformed
+	}
+
+	for i := mapLen(0); i < size && r.err == nil; i++ {
+		k := r.value()
+		key, _ := k.(string)
+		r.skip(k)
+		v := r.value()
+		switch key {
+		case "id":
+			e.ID, ok = v.(uint64)
+		case "type":
+			e.Type, ok = v.(string)
+		case "acct":
+			e.Acct, ok = v.(string)
+		case "time":
+			e.Time, ok = v.(time.Time)
+		case "detail":
+			e.Detail, ok = v.(string)
+		default:
+			r.skip(v)
+		}
+		if !ok {
+			return model.Event{}, ErrMalformed
+		}
+	}
+	if r.err != nil {
+		return model.Event{}, r.err
+	}
+
+	return e, nil
+}
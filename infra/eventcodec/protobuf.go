@@ -0,0 +1,149 @@
+package eventcodec
+
+import (
+	"encoding/binary"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"time"
+)
+
+// Protocol Buffers wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// marshalProtobuf encodes event as Event message of event.proto, zero values are left out
+func marshalProtobuf(e model.Event) []byte {
+	var b []byte
+	if e.ID != 0 {
+		b = appendTag(b, 1, wireVarint)
+		b = binary.AppendUvarint(b, e.ID)
+	}
+	b = appendString(b, 2, e.Type)
+	b = appendString(b, 3, e.Acct)
+	if !e.Time.IsZero() {
+		// google.protobuf.Timestamp with seconds and nanos
+		var ts []byte
+		if sec := e.Time.Unix(); sec != 0 {
+			ts = appendTag(ts, 1, wireVarint)
+			ts = binary.AppendUvarint(ts, uint64(sec))
+		}
+		if nsec := e.Time.Nanosecond(); nsec != 0 {
+			ts = appendTag(ts, 2, wireVarint)
+			ts = binary.AppendUvarint(ts, uint64(nsec))
+		}
+		b = appendTag(b, 4, wireBytes)
+		b = binary.AppendUvarint(b, uint64(len(ts)))
+		b = append(b, ts...)
+	}
+	b = appendString(b, 5, e.Detail)
+	return b
+}
+
+func appendTag(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// unmarshalProtobuf decodes Event message, unknown fields are skipped
+func unmarshalProtobuf(data []byte) (model.Event, error) {
+	var e model.Event
+	err := readFields(data, func(field, wire int, varint uint64, bytes []byte) error {
+		if want, known := eventWireTypes[field]; known && wire != want {
+			return ErrMalformed
+		}
+		switch field {
+		case 1:
+			e.ID = varint
+		case 2:
+			e.Type = string(bytes)
+		case 3:
+			e.Acct = string(bytes)
+		case 4:
+			var sec, nsec int64
+			if err := readFields(bytes, func(field, wire int, varint uint64, _ []byte) error {
+				if (field == 1 || field == 2) && wire != wireVarint {
+					return ErrMalformed
+				}
+				switch field {
+				case 1:
+					sec = int64(varint)
+				case 2:
+					nsec = int64(int32(varint))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if nsec < 0 || nsec >= 1e9 {
+				return ErrMalformed
+			}
+			e.Time = time.Unix(sec, nsec).UTC()
+		case 5:
+			e.Detail = string(bytes)
+		}
+		return nil
+	})
+	return e, err
+}
+
+// eventWireTypes are wire types of known fields of Event message
+var eventWireTypes = map[int]int{1: wireVarint, 2: wireBytes, 3: wireBytes, 4: wireBytes, 5: wireBytes}
+
+// readFields calls fn with number, wire type and value of every field in message,
+// varint for varint fields and bytes for length-delimited ones
+func readFields(data []byte, fn func(field, wire int, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrMalformed
+		}
+		data = data[n:]
+
+		var (
+			varint uint64
+			bytes  []byte
+		)
+		switch tag & 7 {
+		case wireVarint:
+			if varint, n = binary.Uvarint(data); n <= 0 {
+				return ErrMalformed
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return ErrMalformed
+			}
+			data = data[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return ErrMalformed
+			}
+			bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case wireFixed32:
+			if len(data) < 4 {
+				return ErrMalformed
+			}
+			data = data[4:]
+		default:
+			return ErrMalformed
+		}
+
+		if err := fn(int(tag>>3), int(tag&7), varint, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
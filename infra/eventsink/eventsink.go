@@ -0,0 +1,245 @@
+// Provides output of received events in several formats to several sinks at once:
+// standard output, size-rotated file and syslog.
+
+package eventsink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatLogfmt = "logfmt"
+)
+
+// ErrUnknownFormat occurs when output format is not one of the supported ones
+var ErrUnknownFormat = errors.New("unknown format, should be text, json, ndjson or logfmt")
+
+// ErrUnknownSink occurs when sink name is not one of the supported ones
+var ErrUnknownSink = errors.New("unknown sink, should be stdout, file or syslog")
+
+// ErrNoSink occurs when no sink is given, received events would be lost
+var ErrNoSink = errors.New("no sink, should be one or more of stdout, file or syslog")
+
+// Format renders event as one record ending with new line
+func Format(e model.Event, format string) ([]byte, error) {
+	switch format {
+	case FormatText, "":
+		line := fmt.Sprintf("%s #%d %s %s", e.Time.Format(time.RFC3339), e.ID, e.Type, e.Acct)
+		if e.Detail != "" {
+			line += ": " + e.Detail
+		}
+		return []byte(line + "\n"), nil
+	case FormatJSON:
+		data, err := json.MarshalIndent(e, "", "  ")
+		return append(data, '\n'), err
+	case FormatNDJSON:
+		data, err := json.Marshal(e)
+		return append(data, '\n'), err
+	case FormatLogfmt:
+		line := fmt.Sprintf("id=%d type=%s acct=%s time=%s", e.ID, logfmtValue(e.Type),
+			logfmtValue(e.Acct), e.Time.Format(time.RFC3339Nano))
+		if e.Detail != "" {
+			line += " detail=" + logfmtValue(e.Detail)
+		}
+		return []byte(line + "\n"), nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// logfmtValue quotes value when it contains spaces, quotes or equal signs
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// Sink receives formatted records
+type Sink interface {
+	Write(record []byte) error
+	Close() error
+}
+
+// writerSink writes records to standard output or any other writer
+type writerSink struct {
+	w io.Writer
+}
+
+// NewWriterSink creates sink writing to w
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(record []byte) error {
+	_, err := s.w.Write(record)
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// RotatingFile appends records to a file and rotates it when it grows over the maximum size,
+// keeping maxBackups older files as path.1, path.2, ...
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingFile opens file for appending records
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) Write(record []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(record)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.file.Write(record)
+	r.size += int64(n)
+	return err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.file.Close()
+}
+
+// open opens the current file and finds out its size
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts backups by one, the oldest one is dropped, and starts new current file
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	if r.maxBackups > 0 {
+		for i := r.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(r.backup(i), r.backup(i+1))
+		}
+		if err := os.Rename(r.path, r.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+// backup returns name of the n-th backup file
+func (r *RotatingFile) backup(n int) string {
+	return r.path + "." + strconv.Itoa(n)
+}
+
+// Multi writes every record to all sinks
+type Multi []Sink
+
+// Write tries all sinks and returns the first error
+func (m Multi) Write(record []byte) error {
+	var first error
+	for _, s := range m {
+		if err := s.Write(record); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close closes all sinks and returns the first error
+func (m Multi) Close() error {
+	var first error
+	for _, s := range m {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// CheckNames tells whether names are one or more supported sinks
+func CheckNames(names []string) error {
+	if len(names) == 0 {
+		return ErrNoSink
+	}
+	for _, name := range names {
+		switch name {
+		case "stdout", "file", "syslog":
+		default:
+			return fmt.Errorf("%s sink: %w", name, ErrUnknownSink)
+		}
+	}
+	return nil
+}
+
+// Open creates sinks by their names, file sink writes to file rotated at maxSize bytes
+func Open(names []string, file string, maxSize int64, maxBackups int, syslogTag string) (Multi, error) {
+	if len(names) == 0 {
+		return nil, ErrNoSink
+	}
+	var sinks Multi
+	for _, name := range names {
+		var (
+			s   Sink
+			err error
+		)
+		switch name {
+		case "stdout":
+			s = NewWriterSink(os.Stdout)
+		case "file":
+			s, err = NewRotatingFile(file, maxSize, maxBackups)
+		case "syslog":
+			s, err = NewSyslog(syslogTag)
+		default:
+			err = ErrUnknownSink
+		}
+		if err != nil {
+			_ = sinks.Close()
+			return nil, fmt.Errorf("%s sink: %w", name, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
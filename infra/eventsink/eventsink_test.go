@@ -0,0 +1,79 @@
+package eventsink
+
+import (
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	e := model.Event{
+		ID:     7,
+		Type:   model.TopicLoginFailed,
+		Acct:   "jacky_yang",
+		Time:   time.Date(2023, 2, 1, 8, 0, 0, 0, time.UTC),
+		Detail: "Password incorrect",
+	}
+
+	cases := map[string]string{
+		FormatText:   "2023-02-01T08:00:00Z #7 login.failed jacky_yang: Password incorrect\n",
+		FormatNDJSON: `{"id":7,"type":"login.failed","acct":"jacky_yang","time":"2023-02-01T08:00:00Z","detail":"Password incorrect"}` + "\n",
+		FormatLogfmt: `id=7 type=login.failed acct=jacky_yang time=2023-02-01T08:00:00Z detail="Password incorrect"` + "\n",
+	}
+	for format, want := range cases {
+		got, err := Format(e, format)
+		if err != nil || string(got) != want {
+			t.Errorf("Format %s gave %q instead of %q", format, got, want)
+		}
+	}
+
+	if _, err := Format(e, "xml"); err == nil {
+		t.Errorf("Unknown format was accepted")
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	if err := CheckNames([]string{"stdout", "file", "syslog"}); err != nil {
+		t.Errorf("Supported sinks were rejected: %s", err)
+	}
+	if err := CheckNames(nil); !errors.Is(err, ErrNoSink) {
+		t.Errorf("No sinks gave %v", err)
+	}
+	if err := CheckNames([]string{"stdout", "kafka"}); !errors.Is(err, ErrUnknownSink) {
+		t.Errorf("Unknown sink gave %v", err)
+	}
+	if _, err := Open(nil, "", 0, 0, ""); !errors.Is(err, ErrNoSink) {
+		t.Errorf("Opening no sinks gave %v", err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+
+	// Every record over 10 bytes rotates the file, only 2 backups are kept
+	r, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Error opening file: %s", err)
+	}
+	for _, record := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if err = r.Write([]byte(record)); err != nil {
+			t.Fatalf("Error writing record: %s", err)
+		}
+	}
+	if err = r.Close(); err != nil {
+		t.Fatalf("Error closing file: %s", err)
+	}
+
+	for name, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		got, _ := os.ReadFile(name)
+		if string(got) != want {
+			t.Errorf("File %s contains %q instead of %q", name, got, want)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); err == nil {
+		t.Errorf("More backups kept than allowed")
+	}
+}
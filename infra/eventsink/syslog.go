@@ -0,0 +1,30 @@
+//go:build !windows && !plan9
+
+package eventsink
+
+import (
+	"bytes"
+	"log/syslog"
+)
+
+// syslogSink sends records to the local syslog daemon
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslog creates sink sending records with tag to syslog
+func NewSyslog(tag string) (Sink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(record []byte) error {
+	return s.w.Info(string(bytes.TrimRight(record, "\n")))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package eventsink
+
+import (
+	"errors"
+)
+
+// NewSyslog fails, syslog is not available on this platform
+func NewSyslog(tag string) (Sink, error) {
+	return nil, errors.New("syslog sink is not supported on this platform")
+}
@@ -0,0 +1,261 @@
+// Provides filter query language for lists. Clauses are field:operator:value, e.g.
+// fullname:prefix:"Jacky Y" or created_at:gte:2024-01-01, combined with AND, OR and parentheses.
+// Filters are turned into parameterised SQL conditions, values never become part of SQL.
+
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Type of field decides which operators it takes and how its values are read
+type Type int
+
+// Field types
+const (
+	Text Type = iota
+	Time
+)
+
+// Field is a column which may be filtered on
+type Field struct {
+	Column string
+	Type   Type
+}
+
+// Limits of one filter
+const (
+	MaxClauses = 20
+	MaxDepth   = 8
+)
+
+// operators maps operator names to SQL comparison, text operators with patterns have no Time variant
+var operators = map[string]string{
+	"eq":       "=",
+	"prefix":   "LIKE",
+	"contains": "LIKE",
+	"gt":       ">",
+	"gte":      ">=",
+	"lt":       "<",
+	"lte":      "<=",
+}
+
+// Error points at the part of filter which could not be parsed
+type Error struct {
+	Pos    int // position of the clause or token starting at 1
+	Clause string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	if e.Clause == "" {
+		return fmt.Sprintf("%s at position %d", e.Reason, e.Pos)
+	}
+	return fmt.Sprintf("%s in clause %q at position %d", e.Reason, e.Clause, e.Pos)
+}
+
+// token of filter: clause, AND, OR, parenthesis or end
+type token struct {
+	kind  string
+	text  string
+	value string // unquoted value of clause
+	pos   int
+}
+
+// Parse turns filter into SQL condition with its arguments, only fields are allowed
+func Parse(filter string, fields map[string]Field) (string, []interface{}, error) {
+	tokens, err := lex(filter)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p := &parser{tokens: tokens, fields: fields}
+	cond, err := p.expr(0)
+	if err != nil {
+		return "", nil, err
+	}
+	if t := p.peek(); t.kind != "end" {
+		return "", nil, &Error{Pos: t.pos, Reason: fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return cond, p.args, nil
+}
+
+// lex splits filter into tokens, clause values may be quoted with " and escaped with \
+func lex(filter string) ([]token, error) {
+	var tokens []token
+	runes := []rune(filter)
+
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, token{kind: string(r), text: string(r), pos: i + 1})
+			i++
+		default:
+			start := i
+			var (
+				value  strings.Builder
+				quoted bool
+			)
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' {
+				if runes[i] != '"' {
+					value.WriteRune(runes[i])
+					i++
+					continue
+				}
+
+				// Quoted part runs to the closing quote, spaces and parentheses included
+				quoted = true
+				i++
+				for ; i < len(runes) && runes[i] != '"'; i++ {
+					if runes[i] == '\\' && i+1 < len(runes) {
+						i++
+					}
+					value.WriteRune(runes[i])
+				}
+				if i == len(runes) {
+					return nil, &Error{Pos: start + 1, Clause: string(runes[start:]), Reason: "unterminated quote"}
+				}
+				i++
+			}
+
+			text := string(runes[start:i])
+			t := token{kind: "clause", text: text, value: value.String(), pos: start + 1}
+			if upper := strings.ToUpper(text); !quoted && (upper == "AND" || upper == "OR") {
+				t.kind = upper
+			}
+			tokens = append(tokens, t)
+		}
+	}
+
+	return append(tokens, token{kind: "end", text: "end of filter", pos: len(runes) + 1}), nil
+}
+
+// parser builds SQL by recursive descent: expr is terms joined by OR, term is factors joined by AND
+type parser struct {
+	tokens  []token
+	next    int
+	fields  map[string]Field
+	args    []interface{}
+	clauses int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) expr(depth int) (string, error) {
+	return p.join(depth, "OR", p.term)
+}
+
+func (p *parser) term(depth int) (string, error) {
+	return p.join(depth, "AND", p.factor)
+}
+
+// join parses operands separated by operator
+func (p *parser) join(depth int, operator string, operand func(int) (string, error)) (string, error) {
+	first, err := operand(depth)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{first}
+	for p.peek().kind == operator {
+		p.next++
+		part, err := operand(depth)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+
+	if len(parts) == 1 {
+		return first, nil
+	}
+	return "(" + strings.Join(parts, " "+operator+" ") + ")", nil
+}
+
+func (p *parser) factor(depth int) (string, error) {
+	t := p.peek()
+	switch t.kind {
+	case "(":
+		if depth == MaxDepth {
+			return "", &Error{Pos: t.pos, Reason: fmt.Sprintf("parentheses are nested deeper than %d", MaxDepth)}
+		}
+		p.next++
+		cond, err := p.expr(depth + 1)
+		if err != nil {
+			return "", err
+		}
+		if closing := p.peek(); closing.kind != ")" {
+			return "", &Error{Pos: closing.pos, Reason: "missing closing parenthesis"}
+		}
+		p.next++
+		return cond, nil
+	case "clause":
+		p.next++
+		return p.clause(t)
+	}
+	return "", &Error{Pos: t.pos, Reason: fmt.Sprintf("expected clause but found %q", t.text)}
+}
+
+// clause turns field:operator:value into comparison with the value as argument
+func (p *parser) clause(t token) (string, error) {
+	fail := func(reason string) (string, error) {
+		return "", &Error{Pos: t.pos, Clause: t.text, Reason: reason}
+	}
+
+	if p.clauses++; p.clauses > MaxClauses {
+		return fail(fmt.Sprintf("filter has more than %d clauses", MaxClauses))
+	}
+
+	parts := strings.SplitN(t.value, ":", 3)
+	if len(parts) != 3 {
+		return fail("clause should be field:operator:value")
+	}
+	name, op, value := parts[0], parts[1], parts[2]
+
+	f, ok := p.fields[name]
+	if !ok {
+		return fail(fmt.Sprintf("unknown field %q", name))
+	}
+	cmp, ok := operators[op]
+	if !ok {
+		return fail(fmt.Sprintf("unknown operator %q, should be eq, prefix, contains, gt, gte, lt or lte", op))
+	}
+
+	var arg interface{} = value
+	switch {
+	case f.Type == Time && cmp == "LIKE":
+		return fail(fmt.Sprintf("operator %q does not apply to time field", op))
+	case f.Type == Time:
+		ts, err := parseTime(value)
+		if err != nil {
+			return fail("value is not RFC 3339 time or date")
+		}
+		arg = ts
+	case op == "prefix":
+		arg = escapeLike(value) + "%"
+	case op == "contains":
+		arg = "%" + escapeLike(value) + "%"
+	}
+
+	p.args = append(p.args, arg)
+	return f.Column + " " + cmp + " ?", nil
+}
+
+// parseTime reads RFC 3339 time or date
+func parseTime(value string) (time.Time, error) {
+	if ts, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return ts, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// escapeLike escapes wildcards of LIKE pattern, so they match themselves
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
@@ -0,0 +1,80 @@
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fields = map[string]Field{
+	"acct":       {Column: "acct"},
+	"fullname":   {Column: "fullname"},
+	"created_at": {Column: "created_at", Type: Time},
+}
+
+func TestParse(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		filter string
+		cond   string
+		args   []interface{}
+	}{
+		{"acct:eq:jacky_yang", "acct = ?", []interface{}{"jacky_yang"}},
+		{`fullname:prefix:"Jacky Y" and created_at:gte:2024-01-01`,
+			"(fullname LIKE ? AND created_at >= ?)", []interface{}{"Jacky Y%", since}},
+		{`acct:contains:50%_off OR (fullname:eq:"Say \"hi\"" AND created_at:lt:2024-01-01T00:00:00Z)`,
+			"(acct LIKE ? OR (fullname = ? AND created_at < ?))",
+			[]interface{}{`%50\%\_off%`, `Say "hi"`, since}},
+		{"acct:eq:a OR acct:eq:b AND acct:eq:c", "(acct = ? OR (acct = ? AND acct = ?))",
+			[]interface{}{"a", "b", "c"}},
+		{"acct:eq:a:b", "acct = ?", []interface{}{"a:b"}},
+	}
+
+	for _, tt := range tests {
+		cond, args, err := Parse(tt.filter, fields)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.filter, err)
+			continue
+		}
+		if cond != tt.cond || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("Parse(%q) = %q %v, want %q %v", tt.filter, cond, args, tt.cond, tt.args)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		pos    int
+		clause string
+		reason string
+	}{
+		{"acct:eq:a AND pwd:eq:secret", 15, "pwd:eq:secret", "unknown field"},
+		{"acct:like:a", 1, "acct:like:a", "unknown operator"},
+		{"created_at:prefix:2024", 1, "created_at:prefix:2024", "does not apply"},
+		{"acct:eq:a OR created_at:gt:yesterday", 14, "created_at:gt:yesterday", "not RFC 3339"},
+		{"acct", 1, "acct", "should be field:operator:value"},
+		{`acct:eq:"open`, 1, `acct:eq:"open`, "unterminated quote"},
+		{"(acct:eq:a", 11, "", "missing closing parenthesis"},
+		{"acct:eq:a AND", 14, "", "expected clause"},
+		{"acct:eq:a acct:eq:b", 11, "", "unexpected"},
+		{"", 1, "", "expected clause"},
+		{strings.Repeat("(", MaxDepth+1) + "acct:eq:a" + strings.Repeat(")", MaxDepth+1), MaxDepth + 1, "", "nested"},
+		{strings.Repeat("acct:eq:a OR ", MaxClauses) + "acct:eq:a", MaxClauses*13 + 1, "acct:eq:a", "more than"},
+	}
+
+	for _, tt := range tests {
+		_, _, err := Parse(tt.filter, fields)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Parse(%q) error = %v, want *Error", tt.filter, err)
+			continue
+		}
+		if e.Pos != tt.pos || e.Clause != tt.clause || !strings.Contains(e.Reason, tt.reason) {
+			t.Errorf("Parse(%q) error = %+v, want position %d, clause %q and reason with %q",
+				tt.filter, e, tt.pos, tt.clause, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Provides a fan-out hub which broadcasts messages to every registered client.
+// Each client has a bounded buffer, so a slow client never blocks the sender.
+
+package hub
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Policy decides what happens to a client whose buffer is full
+type Policy int
+
+const (
+	// DropMessage skips the message for the slow client and keeps it registered
+	DropMessage Policy = iota
+	// Disconnect unregisters the slow client and closes its message channel
+	Disconnect
+)
+
+// ErrUnknownPolicy occurs when ParsePolicy receives an unknown policy name
+var ErrUnknownPolicy = errors.New("unknown slow consumer policy, should be drop or disconnect")
+
+// ParsePolicy converts policy name from configuration to Policy
+func ParsePolicy(name string) (Policy, error) {
+	switch strings.ToLower(name) {
+	case "", "drop":
+		return DropMessage, nil
+	case "disconnect":
+		return Disconnect, nil
+	}
+	return DropMessage, ErrUnknownPolicy
+}
+
+// Client receives broadcast messages through its buffered channel
+type Client[T any] struct {
+	send    chan T
+	filter  func(T) bool
+	dropped uint64
+}
+
+// Messages returns channel with messages for the client.
+// The channel is closed when the client is unregistered.
+func (c *Client[T]) Messages() <-chan T {
+	return c.send
+}
+
+// Hub keeps registered clients and broadcasts messages to all of them
+type Hub[T any] struct {
+	mu      sync.Mutex
+	clients map[*Client[T]]struct{}
+	bufSize int
+	policy  Policy
+}
+
+// NewHub creates new hub with per-client buffer size and slow consumer policy
+func NewHub[T any](bufSize int, policy Policy) *Hub[T] {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	return &Hub[T]{
+		clients: make(map[*Client[T]]struct{}),
+		bufSize: bufSize,
+		policy:  policy,
+	}
+}
+
+// Register adds new client to the hub, it receives only messages accepted by filter.
+// Client with nil filter receives all messages.
+func (h *Hub[T]) Register(filter func(T) bool) *Client[T] {
+	c := &Client[T]{send: make(chan T, h.bufSize), filter: filter}
+
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+
+	return c
+}
+
+// Unregister removes client from the hub and closes its message channel.
+// It is safe to call for a client which was already disconnected.
+func (h *Hub[T]) Unregister(c *Client[T]) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(c)
+}
+
+// Broadcast sends message to all interested clients without blocking
+func (h *Hub[T]) Broadcast(msg T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		if c.filter != nil && !c.filter(msg) {
+			continue
+		}
+		select {
+		case c.send <- msg:
+		default:
+			// Client buffer is full
+			if h.policy == Disconnect {
+				h.remove(c)
+			} else {
+				c.dropped++
+			}
+		}
+	}
+}
+
+// Len returns number of registered clients
+func (h *Hub[T]) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.clients)
+}
+
+// remove deletes client and closes its channel, caller must hold the lock
+func (h *Hub[T]) remove(c *Client[T]) {
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
@@ -0,0 +1,74 @@
+package hub
+
+import "testing"
+
+func TestBroadcast(t *testing.T) {
+
+	// Every client receives the message
+	h := NewHub[[]byte](4, DropMessage)
+	c1, c2 := h.Register(nil), h.Register(nil)
+	h.Broadcast([]byte("failure"))
+	if msg := <-c1.Messages(); string(msg) != "failure" {
+		t.Errorf("First client received %q instead of broadcast message", msg)
+	}
+	if msg := <-c2.Messages(); string(msg) != "failure" {
+		t.Errorf("Second client received %q instead of broadcast message", msg)
+	}
+
+	// Unregistered client has its channel closed and gets nothing more
+	h.Unregister(c2)
+	h.Unregister(c2)
+	h.Broadcast([]byte("next"))
+	if _, ok := <-c2.Messages(); ok {
+		t.Errorf("Unregistered client still receives messages")
+	}
+	if h.Len() != 1 {
+		t.Errorf("Hub has %d clients instead of 1", h.Len())
+	}
+
+	// Broadcast without clients does not block
+	NewHub[[]byte](1, DropMessage).Broadcast([]byte("nobody listens"))
+
+	// Filtered client receives only accepted messages
+	c3 := h.Register(func(msg []byte) bool { return string(msg) == "wanted" })
+	h.Broadcast([]byte("unwanted"))
+	h.Broadcast([]byte("wanted"))
+	if msg := <-c3.Messages(); string(msg) != "wanted" {
+		t.Errorf("Filtered client received %q", msg)
+	}
+}
+
+func TestSlowConsumerPolicy(t *testing.T) {
+
+	// Drop policy keeps slow client registered with the oldest messages
+	h := NewHub[[]byte](1, DropMessage)
+	c := h.Register(nil)
+	h.Broadcast([]byte("first"))
+	h.Broadcast([]byte("second"))
+	if h.Len() != 1 || c.dropped != 1 {
+		t.Errorf("Drop policy did not drop exactly one message")
+	}
+	if msg := <-c.Messages(); string(msg) != "first" {
+		t.Errorf("Drop policy kept %q instead of first message", msg)
+	}
+
+	// Disconnect policy removes slow client and closes its channel after buffered messages
+	h = NewHub[[]byte](1, Disconnect)
+	c = h.Register(nil)
+	h.Broadcast([]byte("first"))
+	h.Broadcast([]byte("second"))
+	if h.Len() != 0 {
+		t.Errorf("Disconnect policy kept slow client registered")
+	}
+	if msg := <-c.Messages(); string(msg) != "first" {
+		t.Errorf("Disconnect policy lost buffered message")
+	}
+	if _, ok := <-c.Messages(); ok {
+		t.Errorf("Disconnect policy did not close client channel")
+	}
+
+	// Unknown policy name is rejected
+	if _, err := ParsePolicy("block"); err == nil {
+		t.Errorf("Unknown policy name was accepted")
+	}
+}
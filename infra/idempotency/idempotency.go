@@ -0,0 +1,277 @@
+// Provides Idempotency-Key header of POST requests, so clients can retry them safely.
+// The first response to a request with a key is stored for a window and replayed for
+// retries with the same key and payload. The same key with another payload is rejected.
+// Keys belong to the acct of the request, keys of anonymous requests to the route. A request
+// in progress holds its key for a lease, so a retry takes over the key of a crashed request.
+
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// HeaderKey carries the key chosen by the client, unique for every operation it retries
+	HeaderKey = "Idempotency-Key"
+
+	// HeaderReplayed marks responses replayed from the store
+	HeaderReplayed = "Idempotent-Replayed"
+
+	// MaxKeyLength is the longest accepted key
+	MaxKeyLength = 255
+)
+
+// replayedHeaders are response headers stored and replayed with the body
+var replayedHeaders = []string{"Content-Type", "Content-Location", "ETag", "Link", "Location",
+	"X-Content-Type-Options"}
+
+// Keys is the store instance, nil when idempotency keys are not initialized
+var Keys *Store
+
+// InitKeys creates the store instance and starts removing expired keys
+func InitKeys(repo repository.IdempotencyRepository, window, lease time.Duration, maxBodySize int64) {
+	Keys = NewStore(repo, window, lease, maxBodySize)
+	Keys.Start()
+}
+
+// Store keeps responses to requests with idempotency keys
+type Store struct {
+	repo        repository.IdempotencyRepository
+	window      time.Duration
+	lease       time.Duration
+	maxBodySize int64
+	now         func() time.Time
+}
+
+// NewStore creates new store which keeps responses for window, lets requests in progress hold
+// their key for lease and reads request bodies up to maxBodySize bytes
+func NewStore(repo repository.IdempotencyRepository, window, lease time.Duration, maxBodySize int64) *Store {
+	return &Store{
+		repo:        repo,
+		window:      window,
+		lease:       lease,
+		maxBodySize: maxBodySize,
+		now:         time.Now,
+	}
+}
+
+// Start removes expired keys in the background until the process ends
+func (s *Store) Start() {
+	interval := s.window
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := s.repo.DeleteExpired(s.now()); err != nil {
+				log.Println("Error deleting expired idempotency keys: ", err)
+			}
+		}
+	}()
+}
+
+// Handler runs POST requests with Idempotency-Key once and replays their response for retries.
+// Responses with 5xx status are not stored, so the request can be retried with the same key.
+// Keys belong to the acct of the token, so it must run after JWTHandler. Nil store runs
+// requests unchanged.
+func (s *Store) Handler(next http.Handler) http.Handler {
+	return s.handler(next, func(r *http.Request) string {
+		if acct := r.Header.Get("acct"); acct != "" {
+			return "acct:" + acct
+		}
+		return ""
+	})
+}
+
+// AnonymousHandler is Handler of route without token, keys of all its clients belong to the route
+func (s *Store) AnonymousHandler(route string, next http.Handler) http.Handler {
+	return s.handler(next, func(r *http.Request) string {
+		return "route:" + route
+	})
+}
+
+// handler is Handler with keys in scope of request
+func (s *Store) handler(next http.Handler, scope func(r *http.Request) string) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HeaderKey)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validKey(key) {
+			problem.Invalid(w, r, problem.InvalidParam{Name: HeaderKey,
+				Reason: "Key must have 1 to 255 printable ASCII characters"})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBodySize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				problem.Error(w, r, http.StatusRequestEntityTooLarge, "Request body is too large")
+				return
+			}
+			problem.Error(w, r, http.StatusBadRequest, "Request body cannot be read")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		keyScope := scope(r)
+		if keyScope == "" {
+			problem.Internal(w, r, errors.New("idempotency key of request without acct"))
+			return
+		}
+
+		// Postgres keeps microseconds, the lease identifies the claim when it completes
+		now := s.now()
+		claim := model.IdempotencyKey{
+			ID:          scopedID(keyScope, key),
+			Fingerprint: fingerprint(r, body),
+			ExpiresAt:   now.Add(s.window),
+			LockedUntil: now.Add(s.lease).Round(0).Truncate(time.Microsecond),
+		}
+		stored, claimed, err := s.repo.Claim(claim, now)
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			// The key was released between the claim and the read of the stored response
+			problem.Error(w, r, http.StatusConflict, "Request with the same Idempotency-Key is in progress")
+			return
+		case err != nil:
+			problem.Internal(w, r, err)
+			return
+		case !claimed && stored.Fingerprint != claim.Fingerprint:
+			problem.Error(w, r, http.StatusUnprocessableEntity,
+				"Idempotency-Key was already used for another request")
+			return
+		case !claimed && stored.Status == 0:
+			problem.Error(w, r, http.StatusConflict, "Request with the same Idempotency-Key is in progress")
+			return
+		case !claimed:
+			replay(w, stored)
+			return
+		}
+
+		// Release the key when the handler fails or panics, the client retries with it
+		rec := &recorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed {
+				if err := s.repo.Release(claim); err != nil {
+					log.Println("Error releasing idempotency key: ", err)
+				}
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+		claim.Status = rec.status
+		claim.Header = storedHeader(w.Header())
+		claim.Body = rec.body.Bytes()
+		if err := s.repo.Complete(claim); err != nil {
+			log.Println("Error storing response of idempotency key: ", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// replay writes stored response
+func replay(w http.ResponseWriter, stored model.IdempotencyKey) {
+	var header http.Header
+	_ = json.Unmarshal([]byte(stored.Header), &header)
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(HeaderReplayed, "true")
+	w.WriteHeader(stored.Status)
+	_, _ = w.Write(stored.Body)
+}
+
+// storedHeader encodes response headers which are replayed
+func storedHeader(h http.Header) string {
+	header := http.Header{}
+	for _, name := range replayedHeaders {
+		if values := h.Values(name); len(values) > 0 {
+			header[name] = values
+		}
+	}
+	b, _ := json.Marshal(header)
+
+	return string(b)
+}
+
+// validKey accepts keys of printable ASCII characters of reasonable length
+func validKey(key string) bool {
+	if key == "" || len(key) > MaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// scopedID identifies key in scope of acct or route, so clients cannot collide with keys of others
+func scopedID(scope, key string) string {
+	sum := sha256.Sum256([]byte(scope + "\x00" + key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprint identifies the payload of request, the same key sent to another route
+// or with another body does not match
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\x00" + r.Header.Get("Content-Type") + "\x00"))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder passes the response to the client and keeps its status and body
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,259 @@
+package idempotency
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memRepo keeps idempotency keys in memory for tests
+type memRepo struct {
+	mu   sync.Mutex
+	keys map[string]model.IdempotencyKey
+}
+
+func (m *memRepo) Claim(k model.IdempotencyKey, now time.Time) (model.IdempotencyKey, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.keys[k.ID]
+	if ok && stored.ExpiresAt.After(now) && (stored.Status != 0 || stored.LockedUntil.After(now)) {
+		return stored, false, nil
+	}
+	m.keys[k.ID] = k
+	return k, true, nil
+}
+
+// held reports whether key k is still held by its claim
+func (m *memRepo) held(k model.IdempotencyKey) bool {
+	stored, ok := m.keys[k.ID]
+	return ok && stored.Status == 0 && stored.LockedUntil.Equal(k.LockedUntil)
+}
+func (m *memRepo) Complete(k model.IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.held(k) {
+		return repository.ErrNotFound
+	}
+	m.keys[k.ID] = k
+	return nil
+}
+func (m *memRepo) Release(k model.IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held(k) {
+		delete(m.keys, k.ID)
+	}
+	return nil
+}
+func (m *memRepo) DeleteExpired(now time.Time) (int64, error) { return 0, nil }
+
+func TestHandler(t *testing.T) {
+	repo := &memRepo{keys: map[string]model.IdempotencyKey{}}
+	s := NewStore(repo, time.Hour, time.Minute, 1024)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	var calls int
+	status := http.StatusCreated
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-ID", "not-replayed")
+		w.WriteHeader(status)
+		_, _ = w.Write(append([]byte("created "), body...))
+	})
+	authenticated, anonymous := s.Handler(next), s.AnonymousHandler("signup", next)
+
+	// Requests without acct go to the anonymous route
+	send := func(method, key, acct, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/user", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(HeaderKey, key)
+		}
+		h := anonymous
+		if acct != "" {
+			r.Header.Set("acct", acct)
+			h = authenticated
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("POST", "k1", "", "jacky")
+	if w.Code != http.StatusCreated || w.Body.String() != "created jacky" || calls != 1 {
+		t.Fatalf("first request: %d %q, %d calls", w.Code, w.Body.String(), calls)
+	}
+	if w.Header().Get(HeaderReplayed) != "" {
+		t.Errorf("first response marked as replayed")
+	}
+
+	w = send("POST", "k1", "", "jacky")
+	if w.Code != http.StatusCreated || w.Body.String() != "created jacky" || calls != 1 {
+		t.Fatalf("retry: %d %q, %d calls", w.Code, w.Body.String(), calls)
+	}
+	if w.Header().Get(HeaderReplayed) != "true" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("retry headers: %v", w.Header())
+	}
+	if w.Header().Get("X-Request-ID") != "" {
+		t.Errorf("X-Request-ID of the first response replayed")
+	}
+
+	if w = send("POST", "k1", "", "mary"); w.Code != http.StatusUnprocessableEntity || calls != 1 {
+		t.Errorf("another payload: %d, %d calls", w.Code, calls)
+	}
+
+	// Keys of accts and of the anonymous route do not collide
+	if w = send("POST", "k1", "mary", "mary"); w.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("another acct: %d, %d calls", w.Code, calls)
+	}
+
+	// Requests without key or other than POST run every time
+	send("POST", "", "", "jacky")
+	send("PATCH", "k1", "", "jacky")
+	if calls != 4 {
+		t.Errorf("requests without key: %d calls", calls)
+	}
+
+	// Route which should be authenticated does not store keys without acct
+	r := httptest.NewRequest("POST", "/api/v1/webhook", strings.NewReader("jacky"))
+	r.Header.Set(HeaderKey, "k1")
+	w = httptest.NewRecorder()
+	authenticated.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError || calls != 4 {
+		t.Errorf("request without acct: %d, %d calls", w.Code, calls)
+	}
+
+	if w = send("POST", strings.Repeat("k", MaxKeyLength+1), "", "jacky"); w.Code != http.StatusBadRequest {
+		t.Errorf("too long key: %d", w.Code)
+	}
+	if w = send("POST", "k2", "", strings.Repeat("x", 1025)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large body: %d", w.Code)
+	}
+
+	// Failed responses are not stored, the retry runs again
+	status = http.StatusServiceUnavailable
+	send("POST", "k3", "", "jacky")
+	status = http.StatusCreated
+	if w = send("POST", "k3", "", "jacky"); w.Code != http.StatusCreated || calls != 6 {
+		t.Errorf("retry after failure: %d, %d calls", w.Code, calls)
+	}
+
+	// Expired keys run the request again
+	now = now.Add(2 * time.Hour)
+	if w = send("POST", "k1", "", "mary"); w.Code != http.StatusCreated || calls != 7 {
+		t.Errorf("expired key: %d, %d calls", w.Code, calls)
+	}
+}
+
+func TestHandlerInProgress(t *testing.T) {
+	repo := &memRepo{keys: map[string]model.IdempotencyKey{}}
+	s := NewStore(repo, time.Hour, time.Minute, 1024)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := s.AnonymousHandler("signup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("POST", "/api/v1/user", strings.NewReader("jacky"))
+		r.Header.Set(HeaderKey, "k1")
+		return r
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), newRequest())
+		close(done)
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest())
+	if w.Code != http.StatusConflict {
+		t.Errorf("concurrent retry: %d", w.Code)
+	}
+
+	close(release)
+	<-done
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest())
+	if w.Code != http.StatusCreated || w.Header().Get(HeaderReplayed) != "true" {
+		t.Errorf("retry after completion: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var s *Store
+	h := s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("nil store: %d", w.Code)
+	}
+}
+
+func TestHandlerLease(t *testing.T) {
+	repo := &memRepo{keys: map[string]model.IdempotencyKey{}}
+	s := NewStore(repo, time.Hour, time.Minute, 1024)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	// The first request hangs like one on a crashed replica
+	var calls int
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	h := s.AnonymousHandler("signup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		first := calls == 1
+		started <- struct{}{}
+		if first {
+			<-release
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}))
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/user", strings.NewReader("jacky"))
+		r.Header.Set(HeaderKey, "k1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send() }()
+	<-started
+
+	// Retry within the lease waits for the first request
+	now = now.Add(59 * time.Second)
+	if w := send(); w.Code != http.StatusConflict {
+		t.Errorf("retry within lease: %d", w.Code)
+	}
+
+	// Retry after the lease takes the key over and its response is replayed later
+	now = now.Add(time.Second)
+	if w := send(); w.Code != http.StatusCreated || w.Header().Get(HeaderReplayed) != "" || calls != 2 {
+		t.Fatalf("retry after lease: %d, %d calls", w.Code, calls)
+	}
+
+	// The first request finishing late neither overwrites nor releases the key of the retry
+	close(release)
+	<-done
+	w := send()
+	if w.Code != http.StatusCreated || w.Header().Get(HeaderReplayed) != "true" || calls != 2 {
+		t.Errorf("retry after completion: %d %v, %d calls", w.Code, w.Header(), calls)
+	}
+}
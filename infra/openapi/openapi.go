@@ -0,0 +1,396 @@
+// Provides OpenAPI 3.1 document of the API and optional middleware validating requests against it.
+// The document describes every v1 route, a test keeps it in sync with the routes.
+
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Document is the OpenAPI document served to clients
+//
+//go:embed openapi.json
+var Document []byte
+
+// spec is the parsed document, the embedded document is checked by tests
+var spec = mustLoad(Document)
+
+// Schema is the subset of JSON Schema used for parameters and request bodies
+type Schema struct {
+	Type                 string             `json:"type"`
+	Pattern              string             `json:"pattern"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Enum                 []interface{}      `json:"enum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	MinProperties        *int               `json:"minProperties"`
+
+	pattern *regexp.Regexp
+}
+
+// parameter of an operation
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// operation is a method of a path
+type operation struct {
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *Schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// Spec maps path templates and methods to operations
+type Spec struct {
+	paths map[string]map[string]*operation
+}
+
+// Load parses document and compiles its patterns
+func Load(doc []byte) (*Spec, error) {
+	var d struct {
+		Paths map[string]map[string]*operation `json:"paths"`
+	}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, err
+	}
+
+	s := &Spec{paths: make(map[string]map[string]*operation)}
+	for path, ops := range d.Paths {
+		s.paths[path] = make(map[string]*operation)
+		for method, op := range ops {
+			for _, p := range op.Parameters {
+				if err := compile(p.Schema); err != nil {
+					return nil, fmt.Errorf("%s %s parameter %s: %w", method, path, p.Name, err)
+				}
+			}
+			if op.RequestBody != nil {
+				for _, c := range op.RequestBody.Content {
+					if err := compile(c.Schema); err != nil {
+						return nil, fmt.Errorf("%s %s body: %w", method, path, err)
+					}
+				}
+			}
+			s.paths[path][strings.ToUpper(method)] = op
+		}
+	}
+
+	return s, nil
+}
+
+func mustLoad(doc []byte) *Spec {
+	s, err := Load(doc)
+	if err != nil {
+		panic("invalid OpenAPI document: " + err.Error())
+	}
+	return s
+}
+
+// compile compiles patterns of schema and its properties
+func compile(s *Schema) error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	}
+	for _, p := range s.Properties {
+		if err := compile(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Operations lists "METHOD path" of every operation in the document, sorted
+func Operations() []string {
+	var ops []string
+	for path, methods := range spec.paths {
+		for method := range methods {
+			ops = append(ops, method+" "+path)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// routeVariable matches variable of mux path template with its pattern, e.g. {id:[0-9]+}
+var routeVariable = regexp.MustCompile(`\{([^}:]+):[^}]+\}`)
+
+// PathTemplate turns mux path template into OpenAPI one by dropping patterns of variables
+func PathTemplate(muxTemplate string) string {
+	return routeVariable.ReplaceAllString(muxTemplate, "{$1}")
+}
+
+// Validate checks parameters and JSON or form body of requests against the document and answers
+// with validation problem listing invalid fields. Requests of undocumented routes pass.
+func Validate(next http.Handler) http.Handler {
+	return spec.Validator(next)
+}
+
+// Validator returns middleware validating requests against the spec
+func (s *Spec) Validator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tmpl, _ := route.GetPathTemplate()
+		op := s.paths[PathTemplate(tmpl)][r.Method]
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		invalid := validateParameters(op, r)
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if op.RequestBody != nil && op.RequestBody.Content[mediaType].Schema != nil {
+			data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.Cfg.Web.MaxBodySize))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				problem.Error(w, r, http.StatusRequestEntityTooLarge, "Request body is too large")
+				return
+			}
+			if err != nil {
+				problem.Error(w, r, http.StatusBadRequest, "Request body could not be read")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(data))
+
+			// Malformed bodies are left to the handler to report
+			schema := op.RequestBody.Content[mediaType].Schema
+			if body, ok := decodeBody(r, mediaType, data, schema); ok {
+				invalid = append(invalid, validateValue(schema, body, "")...)
+			}
+		}
+
+		if len(invalid) > 0 {
+			problem.Invalid(w, r, invalid...)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateParameters checks path and query parameters, they are strings converted by their schema
+func validateParameters(op *operation, r *http.Request) []problem.InvalidParam {
+	var invalid []problem.InvalidParam
+
+	for _, p := range op.Parameters {
+		var (
+			value   string
+			present bool
+		)
+		switch p.In {
+		case "path":
+			value, present = mux.Vars(r)[p.Name]
+		case "query":
+			present = r.URL.Query().Has(p.Name)
+			value = r.URL.Query().Get(p.Name)
+		default:
+			continue
+		}
+
+		if !present {
+			if p.Required {
+				invalid = append(invalid, problem.InvalidParam{Name: p.Name, Reason: "Parameter is required"})
+			}
+			continue
+		}
+		if p.Schema == nil {
+			continue
+		}
+
+		invalid = append(invalid, validateValue(p.Schema, stringValue(p.Schema, value), p.Name)...)
+	}
+
+	return invalid
+}
+
+// stringValue converts parameter or form value to the type of its schema
+func stringValue(s *Schema, value string) interface{} {
+	if s == nil {
+		return value
+	}
+	switch s.Type {
+	case "integer", "number":
+		return json.Number(value)
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// decodeBody decodes JSON or form body of request to the value checked against schema,
+// it reports false for malformed bodies. The first value of a form field counts, like for handlers.
+func decodeBody(r *http.Request, mediaType string, data []byte, schema *Schema) (interface{}, bool) {
+	var form url.Values
+	switch mediaType {
+	case "application/json":
+		var body interface{}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		return body, dec.Decode(&body) == nil
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(data))
+		if err != nil {
+			return nil, false
+		}
+		form = values
+	case "multipart/form-data":
+		req := r.Clone(r.Context())
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		if err := req.ParseMultipartForm(config.Cfg.Web.MaxBodySize); err != nil {
+			return nil, false
+		}
+		defer req.MultipartForm.RemoveAll()
+		form = req.MultipartForm.Value
+	default:
+		return nil, false
+	}
+
+	body := make(map[string]interface{}, len(form))
+	for key, values := range form {
+		if len(values) > 0 {
+			body[key] = stringValue(schema.Properties[key], values[0])
+		}
+	}
+	return body, true
+}
+
+// validateValue checks JSON value against schema, name is the field path for errors
+func validateValue(s *Schema, v interface{}, name string) []problem.InvalidParam {
+	if s == nil {
+		return nil
+	}
+	fail := func(reason string) []problem.InvalidParam {
+		field := name
+		if field == "" {
+			field = "body"
+		}
+		return []problem.InvalidParam{{Name: field, Reason: reason}}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("Must be an object")
+		}
+		return validateObject(s, obj, name)
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail("Must be a string")
+		}
+		if s.MinLength != nil && len([]rune(str)) < *s.MinLength {
+			return fail(fmt.Sprintf("Must be at least %d characters long", *s.MinLength))
+		}
+		if s.MaxLength != nil && len([]rune(str)) > *s.MaxLength {
+			return fail(fmt.Sprintf("Must be at most %d characters long", *s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fail("Must match pattern " + s.Pattern)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("Must be true or false")
+		}
+	case "integer", "number":
+		num, ok := v.(json.Number)
+		if !ok {
+			return fail("Must be a number")
+		}
+		f, err := num.Float64()
+		if err != nil {
+			return fail("Must be a number")
+		}
+		if _, err = strconv.ParseInt(num.String(), 10, 64); s.Type == "integer" && err != nil {
+			return fail("Must be an integer")
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail(fmt.Sprintf("Must be at least %v", *s.Minimum))
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				return nil
+			}
+		}
+		return fail("Must be one of the allowed values")
+	}
+	return nil
+}
+
+// validateObject checks required, known and present properties of object
+func validateObject(s *Schema, obj map[string]interface{}, name string) []problem.InvalidParam {
+	var invalid []problem.InvalidParam
+	field := func(key string) string {
+		if name == "" {
+			return key
+		}
+		return name + "." + key
+	}
+
+	if s.MinProperties != nil && len(obj) < *s.MinProperties {
+		invalid = append(invalid, problem.InvalidParam{Name: field(""),
+			Reason: fmt.Sprintf("Must have at least %d fields", *s.MinProperties)})
+	}
+	for _, key := range s.Required {
+		if _, ok := obj[key]; !ok {
+			invalid = append(invalid, problem.InvalidParam{Name: field(key), Reason: "Field is required"})
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		prop, ok := s.Properties[key]
+		if !ok {
+			if string(s.AdditionalProperties) == "false" {
+				invalid = append(invalid, problem.InvalidParam{Name: field(key), Reason: "Field is not known"})
+			}
+			continue
+		}
+		invalid = append(invalid, validateValue(prop, obj[key], field(key))...)
+	}
+
+	return invalid
+}
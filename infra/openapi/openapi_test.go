@@ -0,0 +1,202 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDocument(t *testing.T) {
+	var d map[string]interface{}
+	if err := json.Unmarshal(Document, &d); err != nil {
+		t.Fatalf("Document is not valid JSON: %v", err)
+	}
+	if d["openapi"] != "3.1.0" {
+		t.Errorf("Document is not OpenAPI 3.1: %v", d["openapi"])
+	}
+	if len(Operations()) == 0 {
+		t.Errorf("Document has no operations")
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	got := PathTemplate("/api/v1/webhook/dead-letter/{id:[0-9]+}/redeliver")
+	if got != "/api/v1/webhook/dead-letter/{id}/redeliver" {
+		t.Errorf("PathTemplate = %s", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	config.Cfg.Web.MaxBodySize = 1 << 20
+
+	var body string
+	r := mux.NewRouter()
+	r.Use(Validate)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+	}
+	r.HandleFunc("/api/v1/user", handler).Methods("POST", "GET")
+	r.HandleFunc("/api/v1/login", handler).Methods("POST")
+	r.HandleFunc("/api/v1/webhook/{id:[0-9]+}", handler).Methods("DELETE")
+
+	tests := []struct {
+		name, method, url, body string
+		invalid                 []string
+	}{
+		{"valid signup", "POST", "/api/v1/user",
+			`{"acct": "jacky_yang", "fullname": "Jacky Yang", "pwd": "secret123"}`, nil},
+		{"invalid signup", "POST", "/api/v1/user",
+			`{"acct": 7, "pwd": "short", "role": "admin"}`, []string{"fullname", "acct", "pwd", "role"}},
+		{"wrong type", "POST", "/api/v1/user",
+			`{"acct": "jacky_yang", "fullname": "Jacky Yang", "pwd": 12345678}`, []string{"pwd"}},
+		{"login with password set under older rules", "POST", "/api/v1/login",
+			`{"acct": "jacky_yang", "pwd": "密碼密碼"}`, nil},
+		{"login without password", "POST", "/api/v1/login", `{"acct": "jacky_yang", "pwd": ""}`, []string{"pwd"}},
+		{"malformed body is left to handler", "POST", "/api/v1/user", `{"acct":`, nil},
+		{"valid query", "GET", "/api/v1/user?limit=10&count=true", "", nil},
+		{"invalid query", "GET", "/api/v1/user?sortBy=pwd.asc&limit=0&count=maybe", "",
+			[]string{"sortBy", "limit", "count"}},
+		{"valid path", "DELETE", "/api/v1/webhook/3", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body = ""
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if tt.invalid == nil {
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Status = %d, body %s", rec.Code, rec.Body)
+				}
+				if body != tt.body {
+					t.Errorf("Handler got body %q, want %q", body, tt.body)
+				}
+				return
+			}
+
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("Status = %d, want 400", rec.Code)
+			}
+			var p struct {
+				InvalidParams []struct{ Name string } `json:"invalid_params"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, param := range p.InvalidParams {
+				names = append(names, param.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.invalid, ",") {
+				t.Errorf("Invalid params = %v, want %v", names, tt.invalid)
+			}
+		})
+	}
+}
+
+// failingReader fails every read like a broken connection
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestValidateForm(t *testing.T) {
+	config.Cfg.Web.MaxBodySize = 1024
+
+	var form url.Values
+	r := mux.NewRouter()
+	r.Use(Validate)
+	r.HandleFunc("/api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		// Form is parsed from the body left by the validator
+		_ = r.ParseMultipartForm(config.Cfg.Web.MaxBodySize)
+		form = r.PostForm
+	}).Methods("POST")
+
+	// multipartBody encodes fields like curl -F
+	multipartBody := func(fields url.Values) (string, string) {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		for name, values := range fields {
+			_ = mw.WriteField(name, values[0])
+		}
+		_ = mw.Close()
+		return b.String(), mw.FormDataContentType()
+	}
+	valid := url.Values{"acct": {"jacky_yang"}, "fullname": {"Jacky Yang"}, "pwd": {"secret123"}}
+	invalid := url.Values{"acct": {"jacky_yang"}, "pwd": {"short"}, "role": {"admin"}}
+	validMultipart, validType := multipartBody(valid)
+	invalidMultipart, invalidType := multipartBody(invalid)
+
+	tests := []struct {
+		name, contentType, body string
+		invalid                 []string
+	}{
+		{"valid urlencoded", "application/x-www-form-urlencoded", valid.Encode(), nil},
+		{"invalid urlencoded", "application/x-www-form-urlencoded", invalid.Encode(),
+			[]string{"fullname", "pwd", "role"}},
+		{"valid multipart", validType, validMultipart, nil},
+		{"invalid multipart", invalidType, invalidMultipart, []string{"fullname", "pwd", "role"}},
+		{"multipart without boundary is left to handler", "multipart/form-data", validMultipart, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form = nil
+			req := httptest.NewRequest("POST", "/api/v1/user", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if tt.invalid == nil {
+				if rec.Code != http.StatusOK {
+					t.Fatalf("Status = %d, body %s", rec.Code, rec.Body)
+				}
+				if tt.contentType != "multipart/form-data" && form.Get("fullname") != "Jacky Yang" {
+					t.Errorf("Handler got form %v", form)
+				}
+				return
+			}
+
+			var p struct {
+				InvalidParams []struct{ Name string } `json:"invalid_params"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); rec.Code != http.StatusBadRequest || err != nil {
+				t.Fatalf("Status = %d, body %s", rec.Code, rec.Body)
+			}
+			var names []string
+			for _, param := range p.InvalidParams {
+				names = append(names, param.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.invalid, ",") {
+				t.Errorf("Invalid params = %v, want %v", names, tt.invalid)
+			}
+		})
+	}
+
+	// Only body over the limit is too large, other read errors are bad requests
+	for body, want := range map[io.Reader]int{
+		strings.NewReader(strings.Repeat("a", 2048)): http.StatusRequestEntityTooLarge,
+		failingReader{}: http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("POST", "/api/v1/user", body)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("Status = %d, want %d", rec.Code, want)
+		}
+	}
+}
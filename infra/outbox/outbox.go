@@ -0,0 +1,111 @@
+// Provides relay of events from the transactional outbox to the event bus.
+// Events are written to the outbox in the same transaction as the change they describe,
+// so an event goes out only for a committed change and is not lost on crash.
+// The relay publishes them in order, at least once, and queues their webhook deliveries in the
+// transaction which removes them from the outbox. Only one replica relays an event, so webhooks
+// get it once however many replicas run.
+
+package outbox
+
+import (
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"log"
+	"time"
+)
+
+// Publisher is the relay instance
+var Publisher *Relay
+
+// InitPublisher creates the relay instance and starts it
+func InitPublisher(repo repository.OutboxRepository, bus *eventbus.Bus, hooks Webhooks,
+	interval time.Duration, batchSize int) {
+	Publisher = NewRelay(repo, bus, hooks, interval, batchSize)
+	Publisher.Start()
+}
+
+// Webhooks turns published events into deliveries to webhooks interested in them,
+// Notify tells them deliveries were queued
+type Webhooks interface {
+	Deliveries(e model.Event) ([]model.WebhookDelivery, error)
+	Notify()
+}
+
+// Relay moves events from the outbox to the bus and webhooks
+type Relay struct {
+	repo      repository.OutboxRepository
+	bus       *eventbus.Bus
+	hooks     Webhooks
+	interval  time.Duration
+	batchSize int
+	wake      chan struct{}
+}
+
+// NewRelay creates new relay which polls the outbox every interval and publishes
+// up to batchSize events at once, hooks may be nil
+func NewRelay(repo repository.OutboxRepository, bus *eventbus.Bus, hooks Webhooks,
+	interval time.Duration, batchSize int) *Relay {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &Relay{
+		repo:      repo,
+		bus:       bus,
+		hooks:     hooks,
+		interval:  interval,
+		batchSize: batchSize,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Start publishes outbox events in the background until the process ends
+func (r *Relay) Start() {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			r.Flush()
+			select {
+			case <-ticker.C:
+			case <-r.wake:
+			}
+		}
+	}()
+}
+
+// Notify tells the relay new events were committed, so they go out before the next poll.
+// It never blocks and does nothing on nil relay.
+func (r *Relay) Notify() {
+	if r == nil {
+		return
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Flush publishes all events waiting in the outbox
+func (r *Relay) Flush() {
+	for {
+		n, err := r.repo.Drain(r.batchSize, func(o model.OutboxEvent) ([]model.WebhookDelivery, error) {
+			e, err := r.bus.Publish(model.Event{Type: o.Type, Acct: o.Acct, Time: o.Time, Detail: o.Detail})
+			if err != nil || r.hooks == nil {
+				return nil, err
+			}
+			return r.hooks.Deliveries(e)
+		})
+		if err != nil {
+			log.Println("Error relaying outbox events:", err)
+			return
+		}
+		if n > 0 && r.hooks != nil {
+			r.hooks.Notify()
+		}
+		if n < r.batchSize {
+			return
+		}
+	}
+}
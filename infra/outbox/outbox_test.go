@@ -0,0 +1,118 @@
+package outbox
+
+import (
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"github.com/romanzac/gorilla-feast/infra/hub"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// memRepo keeps outbox events and queued webhook deliveries in memory for tests,
+// failing removal once when asked
+type memRepo struct {
+	pending    []model.OutboxEvent
+	queued     []model.WebhookDelivery
+	failRemove bool
+}
+
+func (m *memRepo) Drain(limit int, relay func(e model.OutboxEvent) ([]model.WebhookDelivery, error)) (int, error) {
+	batch := m.pending
+	if len(batch) > limit {
+		batch = batch[:limit]
+	}
+	var deliveries []model.WebhookDelivery
+	for _, e := range batch {
+		d, err := relay(e)
+		if err != nil {
+			return 0, err
+		}
+		deliveries = append(deliveries, d...)
+	}
+	if m.failRemove {
+		m.failRemove = false
+		return 0, errors.New("connection lost")
+	}
+	m.pending = m.pending[len(batch):]
+	m.queued = append(m.queued, deliveries...)
+	return len(batch), nil
+}
+
+// memHooks delivers every event to one webhook and counts notifications
+type memHooks struct {
+	notified int
+}
+
+func (m *memHooks) Deliveries(e model.Event) ([]model.WebhookDelivery, error) {
+	return []model.WebhookDelivery{{WebhookID: 1, EventID: e.ID, Topic: e.Type}}, nil
+}
+func (m *memHooks) Notify() { m.notified++ }
+
+// failingCluster refuses to send events, like a cluster with the database down
+type failingCluster struct{}
+
+func (failingCluster) Send(e model.Event) (model.Event, error) {
+	return model.Event{}, errors.New("connection refused")
+}
+
+func TestFlush(t *testing.T) {
+	repo := &memRepo{failRemove: true}
+	for i := 1; i <= 5; i++ {
+		repo.pending = append(repo.pending, model.OutboxEvent{ID: uint64(i), Type: model.TopicUserCreated,
+			Acct: "user" + strconv.Itoa(i), Time: time.Now()})
+	}
+
+	bus := eventbus.NewBus(16, hub.DropMessage, 10)
+	sub := bus.Subscribe(eventbus.Filter{})
+	hooks := &memHooks{}
+	relay := NewRelay(repo, bus, hooks, time.Minute, 2)
+
+	// Failed removal keeps events in the outbox, they are published again
+	relay.Flush()
+	if len(repo.pending) != 5 {
+		t.Fatalf("Events were removed from outbox after failure, %d left", len(repo.pending))
+	}
+	relay.Flush()
+	if len(repo.pending) != 0 {
+		t.Fatalf("Outbox was not drained, %d left", len(repo.pending))
+	}
+
+	want := []string{"user1", "user2", "user1", "user2", "user3", "user4", "user5"}
+	for i, acct := range want {
+		select {
+		case e := <-sub.Messages():
+			if e.Acct != acct || e.Type != model.TopicUserCreated {
+				t.Errorf("Event %d is %s of %s, want %s", i, e.Type, e.Acct, acct)
+			}
+		default:
+			t.Fatalf("Only %d events were published, want %d", i, len(want))
+		}
+	}
+
+	// Deliveries of the numbered events are queued in order with the drained batches only,
+	// webhooks are notified of every batch
+	if len(repo.queued) != 5 || hooks.notified != 3 {
+		t.Fatalf("Queued %d deliveries with %d notifications, want 5 with 3", len(repo.queued), hooks.notified)
+	}
+	for i, d := range repo.queued {
+		if d.EventID != uint64(i+3) || d.Topic != model.TopicUserCreated {
+			t.Errorf("Delivery %d is of event %d, want %d", i, d.EventID, i+3)
+		}
+	}
+}
+
+func TestFlushClusterDown(t *testing.T) {
+	repo := &memRepo{pending: []model.OutboxEvent{{ID: 1, Type: model.TopicUserCreated, Acct: "jacky_yang"}}}
+	bus := eventbus.NewBus(16, hub.DropMessage, 10)
+	bus.Join(failingCluster{})
+	hooks := &memHooks{}
+
+	// Events which cannot be published stay in the outbox and do not reach webhooks
+	NewRelay(repo, bus, hooks, time.Minute, 2).Flush()
+	if len(repo.pending) != 1 || len(repo.queued) != 0 || hooks.notified != 0 {
+		t.Errorf("Unpublished event left the outbox, %d pending, %d queued for webhooks",
+			len(repo.pending), len(repo.queued))
+	}
+}
@@ -0,0 +1,154 @@
+// Provides keyset pagination: opaque cursors pointing between rows ordered by sort keys
+// and SQL conditions selecting rows after or before them.
+
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidCursor occurs when cursor was not issued by the server or does not fit the query
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Key is a column rows are ordered by. Expr is SQL expression compared instead of the bare
+// column, e.g. with collation or without nulls.
+type Key struct {
+	Column string
+	Expr   string
+	Desc   bool
+}
+
+// expr returns what is compared for the key
+func (k Key) expr() string {
+	if k.Expr != "" {
+		return k.Expr
+	}
+	return k.Column
+}
+
+// MaxSortKeys limits how many keys a sort query may have
+const MaxSortKeys = 4
+
+// ParseSort parses comma separated field.direction keys, e.g. fullname.asc,created_at.desc.
+// Only fields mapped to their SQL expressions are allowed, which keeps user input out of SQL.
+// Tiebreaker field with unique values ends the keys unless it is already one of them.
+func ParseSort(sortBy string, fields map[string]string, tiebreaker string) ([]Key, error) {
+	var keys []Key
+	seen := make(map[string]bool)
+
+	parts := strings.Split(sortBy, ",")
+	if len(parts) > MaxSortKeys {
+		return nil, fmt.Errorf("too many sort keys, at most %d are allowed", MaxSortKeys)
+	}
+	for _, part := range parts {
+		splits := strings.Split(strings.TrimSpace(part), ".")
+		if len(splits) != 2 {
+			return nil, errors.New("unknown sortBy parameter, should be field.orderdirection")
+		}
+
+		field, order := splits[0], splits[1]
+		expr, ok := fields[field]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q in sortBy parameter, should be %s", field, fieldNames(fields))
+		}
+		if order != "desc" && order != "asc" {
+			return nil, errors.New("unknown ordering in sortBy parameter, should be asc or desc")
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("field %q is repeated in sortBy parameter", field)
+		}
+		seen[field] = true
+
+		keys = append(keys, Key{Column: field, Expr: expr, Desc: order == "desc"})
+	}
+
+	if !seen[tiebreaker] {
+		keys = append(keys, Key{Column: tiebreaker, Expr: fields[tiebreaker]})
+	}
+	return keys, nil
+}
+
+// fieldNames lists allowed fields in alphabetical order
+func fieldNames(fields map[string]string) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Cursor points between two rows ordered by Sort. Values are the sort key values of the row
+// next to it, rows after it are selected unless Before is set.
+type Cursor struct {
+	Sort   string   `json:"s"`
+	Values []string `json:"v"`
+	Before bool     `json:"b,omitempty"`
+}
+
+// Encode turns cursor into opaque URL safe string
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode parses cursor made by Encode
+func Decode(s string) (Cursor, error) {
+	var c Cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(data, &c); err != nil || len(c.Values) == 0 {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// Order returns ORDER BY clause for keys, reversed when reading backwards
+func Order(keys []Key, backward bool) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		dir := "ASC"
+		if k.Desc != backward {
+			dir = "DESC"
+		}
+		parts[i] = k.expr() + " " + dir
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Keyset returns WHERE condition with its arguments selecting rows which come after values
+// in the order of keys, or before them when backward is set. Values must match keys.
+func Keyset(keys []Key, values []string, backward bool) (string, []interface{}, error) {
+	if len(values) != len(keys) {
+		return "", nil, ErrInvalidCursor
+	}
+
+	// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ...
+	var (
+		ors  []string
+		args []interface{}
+	)
+	for i, k := range keys {
+		var ands []string
+		for j := 0; j < i; j++ {
+			ands = append(ands, keys[j].expr()+" = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if k.Desc != backward {
+			op = " < ?"
+		}
+		ands = append(ands, k.expr()+op)
+		args = append(args, values[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+
+	return strings.Join(ors, " OR "), args, nil
+}
@@ -0,0 +1,80 @@
+package pagination
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	c := Cursor{Sort: "fullname.asc", Values: []string{"Jacky Yang", "jacky_yang"}, Before: true}
+	got, err := Decode(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("Decode = %+v, want %+v", got, c)
+	}
+
+	for _, s := range []string{"", "not base64!", "bm90IGpzb24", Cursor{Sort: "acct.asc"}.Encode()} {
+		if _, err = Decode(s); err != ErrInvalidCursor {
+			t.Errorf("Decode(%q) error = %v, want ErrInvalidCursor", s, err)
+		}
+	}
+}
+
+func TestKeyset(t *testing.T) {
+	keys := []Key{{Column: "created_at", Desc: true}, {Column: "acct"}}
+
+	cond, args, err := Keyset(keys, []string{"2024-01-02T03:04:05Z", "jacky_yang"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cond != "(created_at < ?) OR (created_at = ? AND acct > ?)" {
+		t.Errorf("Keyset condition = %s", cond)
+	}
+	want := []interface{}{"2024-01-02T03:04:05Z", "2024-01-02T03:04:05Z", "jacky_yang"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("Keyset args = %v, want %v", args, want)
+	}
+
+	cond, _, _ = Keyset(keys, []string{"2024-01-02T03:04:05Z", "jacky_yang"}, true)
+	if cond != "(created_at > ?) OR (created_at = ? AND acct < ?)" {
+		t.Errorf("Backward keyset condition = %s", cond)
+	}
+	if order := Order(keys, true); order != "created_at ASC, acct DESC" {
+		t.Errorf("Backward order = %s", order)
+	}
+
+	if _, _, err = Keyset(keys, []string{"jacky_yang"}, false); err != ErrInvalidCursor {
+		t.Errorf("Keyset with missing values error = %v", err)
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	fields := map[string]string{"acct": "", "fullname": `fullname COLLATE "und-x-icu"`, "created_at": ""}
+
+	keys, err := ParseSort("fullname.asc, created_at.desc", fields, "acct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Key{{Column: "fullname", Expr: `fullname COLLATE "und-x-icu"`}, {Column: "created_at", Desc: true},
+		{Column: "acct"}}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("ParseSort = %+v, want %+v", keys, want)
+	}
+	if order := Order(keys, false); order != `fullname COLLATE "und-x-icu" ASC, created_at DESC, acct ASC` {
+		t.Errorf("Order = %s", order)
+	}
+
+	keys, _ = ParseSort("acct.desc", fields, "acct")
+	if !reflect.DeepEqual(keys, []Key{{Column: "acct", Desc: true}}) {
+		t.Errorf("ParseSort with tiebreaker = %+v", keys)
+	}
+
+	for _, sortBy := range []string{"pwd.asc", "acct;DROP TABLE users.asc", "acct.up", "acct", "acct.asc,acct.desc",
+		"acct.asc,fullname.asc,created_at.asc,acct.asc,fullname.asc"} {
+		if _, err = ParseSort(sortBy, fields, "acct"); err == nil {
+			t.Errorf("ParseSort(%q) succeeded", sortBy)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Provides RFC 7807 problem details, the one format of error responses across the API.
+// Internal errors are logged with an error ID, clients get the ID but never the error itself.
+
+package problem
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// ContentType of problem responses
+const ContentType = "application/problem+json"
+
+// HeaderRequestID carries ID of the request, set by the client or generated by middleware
+const HeaderRequestID = "X-Request-ID"
+
+// Problem types beyond about:blank, which means the status says it all
+const (
+	TypeBlank      = "about:blank"
+	TypeValidation = "/problems/validation"
+	TypeInternal   = "/problems/internal"
+)
+
+// InvalidParam names input field which failed validation and why
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Problem describes an error in response body
+type Problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	Instance      string         `json:"instance,omitempty"`
+	RequestID     string         `json:"request_id,omitempty"`
+	ErrorID       string         `json:"error_id,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid_params,omitempty"`
+}
+
+// New creates problem with status and detail about the request
+func New(r *http.Request, status int, detail string) *Problem {
+	return &Problem{
+		Type:      TypeBlank,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: r.Header.Get(HeaderRequestID),
+	}
+}
+
+// Write sends problem as response
+func (p *Problem) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Println("Error encoding problem:", err)
+	}
+}
+
+// Error sends problem with status and detail, detail must be safe to show to the client
+func Error(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	New(r, status, detail).Write(w)
+}
+
+// Invalid sends validation problem listing invalid fields
+func Invalid(w http.ResponseWriter, r *http.Request, params ...InvalidParam) {
+	p := New(r, http.StatusBadRequest, "Request has invalid fields")
+	p.Type = TypeValidation
+	p.Title = "Validation failed"
+	p.InvalidParams = params
+	if len(params) == 1 {
+		p.Detail = params[0].Reason
+	}
+	p.Write(w)
+}
+
+// Internal logs err with new error ID and sends problem with only the ID
+func Internal(w http.ResponseWriter, r *http.Request, err error) {
+	errorID := NewID()
+	log.Printf("Error %s in %s %s: %s", errorID, r.Method, r.URL.Path, err)
+
+	p := New(r, http.StatusInternalServerError, "Internal error, refer to error ID when reporting it")
+	p.Type = TypeInternal
+	p.ErrorID = errorID
+	p.Write(w)
+}
+
+// NewID generates random ID for requests and errors
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
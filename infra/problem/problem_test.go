@@ -0,0 +1,53 @@
+package problem
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInvalid(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/user", nil)
+	r.Header.Set(HeaderRequestID, "req-1")
+	w := httptest.NewRecorder()
+
+	Invalid(w, r, InvalidParam{Name: "acct", Reason: "Acct is not valid username"},
+		InvalidParam{Name: "pwd", Reason: "Password length is less than 8 characters"})
+
+	var p Problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatalf("Problem is not valid JSON: %s", err)
+	}
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != ContentType {
+		t.Errorf("Problem sent with status %d and Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if p.Type != TypeValidation || p.Status != http.StatusBadRequest || p.Instance != "/api/v1/user" ||
+		p.RequestID != "req-1" || len(p.InvalidParams) != 2 || p.InvalidParams[1].Name != "pwd" {
+		t.Errorf("Problem has wrong fields: %+v", p)
+	}
+}
+
+func TestInternal(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/user", nil)
+	w := httptest.NewRecorder()
+	Internal(w, r, errors.New("pq: relation \"users\" does not exist"))
+
+	var p Problem
+	_ = json.NewDecoder(w.Body).Decode(&p)
+	if p.Status != http.StatusInternalServerError || p.ErrorID == "" || strings.Contains(p.Detail, "relation") {
+		t.Errorf("Internal problem has wrong fields or leaks the error: %+v", p)
+	}
+	if !strings.Contains(logged.String(), p.ErrorID) || !strings.Contains(logged.String(), "relation") {
+		t.Errorf("Error was not logged with its ID: %s", logged.String())
+	}
+}
@@ -3,13 +3,16 @@ package router
 import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"net/http"
+	"net/url"
+	"strings"
 )
 
 // Mux router engine with websocket upgrader
 var (
-	R               *mux.Router
-	Upgrader        websocket.Upgrader
-	LoginFailuresCh = make(chan string)
+	R        *mux.Router
+	Upgrader websocket.Upgrader
 )
 
 // NewRouter init
@@ -18,8 +21,29 @@ func NewRouter() *mux.Router {
 	// Router instance
 	R = mux.NewRouter()
 
-	// Websocket connection upgrader
-	Upgrader = websocket.Upgrader{} // initialize with default options
+	// Websocket connection upgrader, compression is used only when the client asks for it
+	Upgrader = websocket.Upgrader{CheckOrigin: checkOrigin, EnableCompression: config.Cfg.Web.WSCompression}
 
 	return R
 }
+
+// checkOrigin accepts clients without Origin header, origins from the allowed list,
+// or only the same origin when no list is configured
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(config.Cfg.Web.WSAllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, allowed := range config.Cfg.Web.WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
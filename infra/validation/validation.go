@@ -0,0 +1,148 @@
+// Provides validation of user fields shared by all handlers. Values are normalized to Unicode NFC
+// with surrounding spaces trimmed before they are matched against configurable patterns, so names
+// in any script pass while lookalike encodings of the same name are stored only once.
+
+package validation
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Default patterns. Accts are ASCII identifiers, fullnames are letters of any script, e.g.
+// "Jacky Yang", "王小明", "Mary-Jane O'Neil" or "J. R. R. Tolkien", in words joined by spaces,
+// hyphens, apostrophes or dots.
+const (
+	DefaultAcctPattern     = `^[a-z_][a-z0-9_]{3,30}$`
+	DefaultFullnamePattern = `^\p{L}\p{M}*(?:(?:[-'’.]|\.? )?\p{L}\p{M}*)*\.?$`
+)
+
+// Length limits in characters
+const (
+	MaxFullnameLength = 100
+	MinPwdLength      = 8
+	MaxPwdLength      = 1024
+)
+
+// Error tells which field is invalid and why, Reason is meant for clients
+type Error struct {
+	Field  string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// Rules validate user fields
+type Rules struct {
+	acct     *regexp.Regexp
+	fullname *regexp.Regexp
+	reserved map[string]bool
+}
+
+// Users are the rules used by handlers
+var Users *Rules
+
+// InitUsers compiles rules used by handlers
+func InitUsers(acctPattern, fullnamePattern string, reserved []string) error {
+	rules, err := New(acctPattern, fullnamePattern, reserved)
+	if err != nil {
+		return err
+	}
+	Users = rules
+	return nil
+}
+
+// New compiles patterns of acct and fullname, empty ones fall back to defaults.
+// Reserved accts cannot be signed up, they are compared after normalization.
+func New(acctPattern, fullnamePattern string, reserved []string) (*Rules, error) {
+	if acctPattern == "" {
+		acctPattern = DefaultAcctPattern
+	}
+	if fullnamePattern == "" {
+		fullnamePattern = DefaultFullnamePattern
+	}
+
+	r := &Rules{reserved: make(map[string]bool)}
+	var err error
+	if r.acct, err = regexp.Compile(acctPattern); err != nil {
+		return nil, fmt.Errorf("acct pattern: %w", err)
+	}
+	if r.fullname, err = regexp.Compile(fullnamePattern); err != nil {
+		return nil, fmt.Errorf("fullname pattern: %w", err)
+	}
+	for _, acct := range reserved {
+		r.reserved[strings.ToLower(Normalize(acct))] = true
+	}
+
+	return r, nil
+}
+
+// Normalize returns value in NFC with surrounding spaces trimmed and inner runs of spaces
+// turned into single space
+func Normalize(value string) string {
+	return strings.Join(strings.FieldsFunc(norm.NFC.String(value), unicode.IsSpace), " ")
+}
+
+// Acct normalizes and checks acct of existing user
+func (r *Rules) Acct(acct string) (string, error) {
+	acct = Normalize(acct)
+	if !r.acct.MatchString(acct) {
+		return acct, &Error{Field: "acct", Reason: "Acct is not valid username"}
+	}
+	return acct, nil
+}
+
+// NewAcct normalizes and checks acct of user to sign up, reserved accts are refused
+func (r *Rules) NewAcct(acct string) (string, error) {
+	acct, err := r.Acct(acct)
+	if err != nil {
+		return acct, err
+	}
+	if r.reserved[strings.ToLower(acct)] {
+		return acct, &Error{Field: "acct", Reason: "Acct is reserved"}
+	}
+	return acct, nil
+}
+
+// Fullname normalizes and checks fullname
+func (r *Rules) Fullname(fullname string) (string, error) {
+	fullname = Normalize(fullname)
+	if n := utf8.RuneCountInString(fullname); n == 0 || n > MaxFullnameLength {
+		return fullname, &Error{Field: "fullname",
+			Reason: fmt.Sprintf("Fullname must have 1 to %d characters", MaxFullnameLength)}
+	}
+	if !r.fullname.MatchString(fullname) {
+		return fullname, &Error{Field: "fullname", Reason: "Fullname contains characters which are not allowed"}
+	}
+	return fullname, nil
+}
+
+// Pwd normalizes password to NFC, so it does not depend on the keyboard, and checks its length.
+// Spaces in passwords are kept.
+func (r *Rules) Pwd(pwd string) (string, error) {
+	pwd = norm.NFC.String(pwd)
+	n := utf8.RuneCountInString(pwd)
+	if n < MinPwdLength {
+		return pwd, &Error{Field: "pwd", Reason: fmt.Sprintf("Password length is less than %d characters", MinPwdLength)}
+	}
+	if n > MaxPwdLength {
+		return pwd, &Error{Field: "pwd", Reason: fmt.Sprintf("Password length is more than %d characters", MaxPwdLength)}
+	}
+	return pwd, nil
+}
+
+// LoginPwd normalizes password to log in with like Pwd, but checks only that it is not empty.
+// Passwords set under older length rules must keep working, their hash decides.
+func (r *Rules) LoginPwd(pwd string) (string, error) {
+	pwd = norm.NFC.String(pwd)
+	if pwd == "" {
+		return pwd, &Error{Field: "pwd", Reason: "Password is empty"}
+	}
+	return pwd, nil
+}
@@ -0,0 +1,101 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFullname(t *testing.T) {
+	rules, err := New("", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]string{
+		"Jacky Yang":              "Jacky Yang",
+		"  Jacky   Yang ":         "Jacky Yang",
+		"王小明":                     "王小明",
+		"Mary-Jane O'Neil":        "Mary-Jane O'Neil",
+		"J. R. R. Tolkien":        "J. R. R. Tolkien",
+		"Madonna":                 "Madonna",
+		"José María Aznar":        "José María Aznar",
+		"Jose\u0301 Garci\u0301a": "Jos\u00e9 Garc\u00eda",
+		"Nguyễn Thị Minh Khai":    "Nguyễn Thị Minh Khai",
+	}
+	for in, want := range valid {
+		got, err := rules.Fullname(in)
+		if err != nil || got != want {
+			t.Errorf("Fullname(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "   ", "Jacky  -Yang", "Jacky Yang1", "<script>", "-Jacky", "Jacky--Yang",
+		string(make([]rune, MaxFullnameLength+1))} {
+		if _, err := rules.Fullname(in); err == nil {
+			t.Errorf("Fullname(%q) succeeded", in)
+		}
+	}
+}
+
+func TestAcct(t *testing.T) {
+	rules, err := New("", "", []string{"admin", "Root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if acct, err := rules.NewAcct(" jacky_yang "); err != nil || acct != "jacky_yang" {
+		t.Errorf("NewAcct = %q, %v", acct, err)
+	}
+	if _, err = rules.NewAcct("root"); err == nil || err.(*Error).Reason != "Acct is reserved" {
+		t.Errorf("NewAcct of reserved acct error = %v", err)
+	}
+	if _, err = rules.Acct("root"); err != nil {
+		t.Errorf("Acct of existing reserved acct error = %v", err)
+	}
+	if _, err = rules.Acct("Jacky"); err == nil || err.(*Error).Field != "acct" {
+		t.Errorf("Acct of invalid acct error = %v", err)
+	}
+
+	custom, err := New(`^[a-z]{2,8}$`, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = custom.Acct("ab"); err != nil {
+		t.Errorf("Acct with custom pattern error = %v", err)
+	}
+	if _, err = New("(", "", nil); err == nil {
+		t.Errorf("New with invalid pattern succeeded")
+	}
+}
+
+func TestPwd(t *testing.T) {
+	rules, _ := New("", "", nil)
+
+	if pwd, err := rules.Pwd("pa\u0301ssword"); err != nil || pwd != "p\u00e1ssword" {
+		t.Errorf("Pwd = %q, %v", pwd, err)
+	}
+	// Eight characters of three bytes each are long enough
+	if _, err := rules.Pwd("密碼密碼密碼密碼"); err != nil {
+		t.Errorf("Pwd of Chinese password error = %v", err)
+	}
+	if _, err := rules.Pwd("short"); err == nil {
+		t.Errorf("Pwd of short password succeeded")
+	}
+}
+
+func TestLoginPwd(t *testing.T) {
+	rules, _ := New("", "", nil)
+
+	if pwd, err := rules.LoginPwd("pa\u0301ss"); err != nil || pwd != "p\u00e1ss" {
+		t.Errorf("LoginPwd = %q, %v", pwd, err)
+	}
+	// Length rules of new passwords do not apply, older passwords may be shorter or longer
+	for _, pwd := range []string{"密碼密碼", strings.Repeat("a", MaxPwdLength+1)} {
+		if _, err := rules.LoginPwd(pwd); err != nil {
+			t.Errorf("LoginPwd of %d characters error = %v", len([]rune(pwd)), err)
+		}
+	}
+	if _, err := rules.LoginPwd(""); err == nil {
+		t.Errorf("LoginPwd of empty password succeeded")
+	}
+}
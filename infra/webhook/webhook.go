@@ -0,0 +1,260 @@
+// Provides delivery of events to registered webhooks.
+// Events are queued in the database and every webhook gets them in order. They are signed with
+// HMAC-SHA256 and posted by a pool of workers separate from request handling, workers of all
+// replicas share the queue. Failed deliveries are retried with exponential back-off and end up
+// as dead letters.
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"github.com/romanzac/gorilla-feast/infra/eventbus"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of webhook requests
+const (
+	HeaderEvent     = "X-Gorilla-Feast-Event"
+	HeaderDelivery  = "X-Gorilla-Feast-Delivery"
+	HeaderTimestamp = "X-Gorilla-Feast-Timestamp"
+	HeaderSignature = "X-Gorilla-Feast-Signature"
+)
+
+const (
+	// hooksRefresh is how often registered webhooks are reloaded, they can change on other replicas
+	hooksRefresh = 30 * time.Second
+	// deliveryPoll is how often idle workers look for due deliveries, e.g. retries or those of other replicas
+	deliveryPoll = time.Second
+	// leaseMargin is how much longer than timeout of an attempt its delivery is leased, so the result
+	// is saved before other workers may attempt the delivery again
+	leaseMargin = 30 * time.Second
+	// maxBackoff caps the back-off between retries
+	maxBackoff = time.Hour
+)
+
+// Deliveries is the dispatcher instance
+var Deliveries *Dispatcher
+
+// InitDeliveries creates the dispatcher instance and starts its workers
+func InitDeliveries(repo repository.WebhookRepository, workers, maxAttempts int, backoff, timeout time.Duration) {
+	Deliveries = NewDispatcher(repo, maxAttempts, backoff, timeout)
+	Deliveries.Start(workers)
+}
+
+// Sign computes signature of the payload sent at timestamp. Receivers should compute the same
+// over "<timestamp>.<body>" and reject old timestamps to stop replays.
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers events to webhooks
+type Dispatcher struct {
+	repo        repository.WebhookRepository
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	lease       time.Duration
+	wake        chan struct{}
+	poll        time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	hooks    []model.Webhook
+	loadedAt time.Time
+}
+
+// NewDispatcher creates new dispatcher with attempts per delivery,
+// back-off before the first retry and timeout of one attempt
+func NewDispatcher(repo repository.WebhookRepository, maxAttempts int, backoff, timeout time.Duration) *Dispatcher {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &Dispatcher{
+		repo:        repo,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		lease:       timeout + leaseMargin,
+		wake:        make(chan struct{}, 1),
+		poll:        deliveryPoll,
+		now:         time.Now,
+	}
+}
+
+// Start runs delivery workers
+func (d *Dispatcher) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			ticker := time.NewTicker(d.poll)
+			defer ticker.Stop()
+
+			for {
+				found, err := d.repo.AttemptDelivery(d.now(), d.lease, d.attempt)
+				if err != nil {
+					log.Println("Error delivering to webhooks:", err)
+				}
+				if found && err == nil {
+					// More deliveries may be due, wake another worker for them
+					d.Notify()
+					continue
+				}
+				select {
+				case <-ticker.C:
+				case <-d.wake:
+				}
+			}
+		}()
+	}
+}
+
+// Notify wakes a worker for new deliveries without blocking
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Deliveries returns deliveries of event to every webhook interested in its type
+func (d *Dispatcher) Deliveries(e model.Event) ([]model.WebhookDelivery, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("encoding event %d for webhooks: %w", e.ID, err)
+	}
+
+	var deliveries []model.WebhookDelivery
+	for _, hook := range d.webhooks() {
+		filter, _ := eventbus.ParseFilter(hook.EventTypes, "")
+		if filter.Match(e) {
+			deliveries = append(deliveries, model.WebhookDelivery{WebhookID: hook.ID, EventID: e.ID,
+				Topic: e.Type, Payload: string(payload), NextAttemptAt: d.now()})
+		}
+	}
+	return deliveries, nil
+}
+
+// Redeliver queues dead letter for its webhook again with fresh attempts,
+// the dead letter is removed only when the delivery is queued
+func (d *Dispatcher) Redeliver(id uint64) error {
+	deadLetter, err := d.repo.FindDeadLetter(id)
+	if err != nil {
+		return err
+	}
+	if _, err = d.repo.Find(deadLetter.WebhookID); err != nil {
+		return err
+	}
+
+	var e model.Event
+	if err = json.Unmarshal([]byte(deadLetter.Payload), &e); err != nil {
+		return fmt.Errorf("decoding dead letter %d: %w", id, err)
+	}
+
+	err = d.repo.RequeueDeadLetter(id, model.WebhookDelivery{WebhookID: deadLetter.WebhookID,
+		EventID: deadLetter.EventID, Topic: e.Type, Payload: deadLetter.Payload, NextAttemptAt: d.now()})
+	if err != nil {
+		return err
+	}
+	d.Notify()
+	return nil
+}
+
+// Reload makes the dispatcher read registered webhooks again before the next event
+func (d *Dispatcher) Reload() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.loadedAt = time.Time{}
+}
+
+// webhooks returns registered webhooks, reloaded from repository when they are too old
+func (d *Dispatcher) webhooks() []model.Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if time.Since(d.loadedAt) > hooksRefresh {
+		hooks, err := d.repo.FindAll()
+		if err != nil {
+			log.Println("Error loading webhooks: ", err)
+			return d.hooks
+		}
+		d.hooks, d.loadedAt = hooks, time.Now()
+	}
+	return d.hooks
+}
+
+// attempt makes one attempt of delivery and schedules retry when it fails
+func (d *Dispatcher) attempt(hook model.Webhook, job *model.WebhookDelivery) repository.DeliveryResult {
+	job.Attempts++
+
+	err := d.post(hook, *job)
+	if err == nil {
+		return repository.DeliverySucceeded
+	}
+	job.LastError = err.Error()
+
+	if job.Attempts >= d.maxAttempts {
+		log.Printf("Webhook %d delivery of event %d failed for good: %s", hook.ID, job.EventID, err)
+		return repository.DeliveryFailed
+	}
+
+	// Later events of the webhook wait for the retry, so they do not overtake this one
+	wait := d.retryDelay(job.Attempts)
+	job.NextAttemptAt = d.now().Add(wait)
+	log.Printf("Webhook %d delivery of event %d failed, retrying in %s: %s", hook.ID, job.EventID, wait, err)
+	return repository.DeliveryRetried
+}
+
+// retryDelay doubles the back-off with every failed attempt up to maxBackoff
+func (d *Dispatcher) retryDelay(attempts int) time.Duration {
+	wait := d.backoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
+
+// post sends signed payload to the webhook URL, any non-2xx status is a failure
+func (d *Dispatcher) post(hook model.Webhook, job model.WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, strings.NewReader(job.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, job.Topic)
+	req.Header.Set(HeaderDelivery, strconv.FormatUint(job.EventID, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, timestamp, []byte(job.Payload)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %s", strings.TrimSpace(resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package webhook
+
+import (
+	"errors"
+	"github.com/romanzac/gorilla-feast/domain/model"
+	"github.com/romanzac/gorilla-feast/domain/repository"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memRepo keeps webhooks, deliveries and dead letters in memory for tests. Like the database,
+// only the oldest delivery of a webhook is due and one attempt at a time runs for a webhook.
+type memRepo struct {
+	mu          sync.Mutex
+	hooks       []model.Webhook
+	deliveries  []model.WebhookDelivery
+	attempting  map[uint64]bool
+	deadLetters []model.WebhookDeadLetter
+	lastID      uint64
+}
+
+func (m *memRepo) FindAll() ([]model.Webhook, error) { return m.hooks, nil }
+func (m *memRepo) Find(id uint64) (model.Webhook, error) {
+	for _, hook := range m.hooks {
+		if hook.ID == id {
+			return hook, nil
+		}
+	}
+	return model.Webhook{}, repository.ErrNotFound
+}
+func (m *memRepo) Create(url, eventTypes, secret string) (model.Webhook, error) {
+	return model.Webhook{}, nil
+}
+func (m *memRepo) Delete(id uint64) error { return nil }
+func (m *memRepo) addDeliveries(deliveries []model.WebhookDelivery) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range deliveries {
+		m.lastID++
+		d.ID = m.lastID
+		m.deliveries = append(m.deliveries, d)
+	}
+}
+func (m *memRepo) AttemptDelivery(now time.Time, _ time.Duration,
+	attempt func(hook model.Webhook, d *model.WebhookDelivery) repository.DeliveryResult) (bool, error) {
+	m.mu.Lock()
+	i := -1
+	seen := map[uint64]bool{}
+	for j, d := range m.deliveries {
+		if !seen[d.WebhookID] && !m.attempting[d.WebhookID] && !d.NextAttemptAt.After(now) {
+			i = j
+			break
+		}
+		seen[d.WebhookID] = true
+	}
+	if i < 0 {
+		m.mu.Unlock()
+		return false, nil
+	}
+	d := m.deliveries[i]
+	m.attempting[d.WebhookID] = true
+	m.mu.Unlock()
+
+	hook, _ := m.Find(d.WebhookID)
+	result := attempt(hook, &d)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempting, d.WebhookID)
+	for j := range m.deliveries {
+		if m.deliveries[j].ID != d.ID {
+			continue
+		}
+		switch result {
+		case repository.DeliveryRetried:
+			m.deliveries[j] = d
+		case repository.DeliveryFailed:
+			m.deadLetters = append(m.deadLetters, model.WebhookDeadLetter{ID: uint64(len(m.deadLetters) + 1),
+				WebhookID: d.WebhookID, EventID: d.EventID, Payload: d.Payload, Attempts: d.Attempts,
+				LastError: d.LastError})
+			fallthrough
+		default:
+			m.deliveries = append(m.deliveries[:j], m.deliveries[j+1:]...)
+		}
+		break
+	}
+	return true, nil
+}
+func (m *memRepo) FindDeadLetters() ([]model.WebhookDeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]model.WebhookDeadLetter{}, m.deadLetters...), nil
+}
+func (m *memRepo) FindDeadLetter(id uint64) (model.WebhookDeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.deadLetters {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return model.WebhookDeadLetter{}, repository.ErrNotFound
+}
+func (m *memRepo) RequeueDeadLetter(id uint64, d model.WebhookDelivery) error {
+	m.mu.Lock()
+	for i, deadLetter := range m.deadLetters {
+		if deadLetter.ID == id {
+			m.deadLetters = append(m.deadLetters[:i], m.deadLetters[i+1:]...)
+			m.mu.Unlock()
+			m.addDeliveries([]model.WebhookDelivery{d})
+			return nil
+		}
+	}
+	m.mu.Unlock()
+	return repository.ErrNotFound
+}
+
+func (m *memRepo) pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.deliveries)
+}
+
+// waitFor polls cond until it holds or fails the test after a while
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	var mu sync.Mutex
+	var failures int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// First attempt of every delivery fails
+		mu.Lock()
+		failures++
+		fail := failures%2 == 1
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	repo := &memRepo{attempting: map[uint64]bool{}, hooks: []model.Webhook{
+		{ID: 1, URL: srv.URL, EventTypes: "login.*", Secret: "0123456789abcdef"},
+		{ID: 2, URL: "http://127.0.0.1:1/unreachable", EventTypes: "user.deleted", Secret: "0123456789abcdef"},
+	}}
+	d := NewDispatcher(repo, 2, time.Millisecond, time.Second)
+	d.poll = 5 * time.Millisecond
+	d.Start(4)
+
+	// dispatch queues deliveries of event like the outbox relay
+	dispatch := func(e model.Event) {
+		deliveries, err := d.Deliveries(e)
+		if err != nil {
+			t.Fatalf("Deliveries failed: %s", err)
+		}
+		if len(deliveries) != 1 {
+			t.Fatalf("Event %d goes to %d webhooks, want 1", e.ID, len(deliveries))
+		}
+		repo.addDeliveries(deliveries)
+		d.Notify()
+	}
+
+	// Events are delivered on retry with valid signature and in order, uninterested webhook gets nothing
+	for id := uint64(7); id <= 9; id++ {
+		dispatch(model.Event{ID: id, Type: model.TopicLoginFailed, Acct: "jacky_yang"})
+	}
+	for id := 7; id <= 9; id++ {
+		select {
+		case r := <-received:
+			body := <-bodies
+			ts, _ := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+			if r.Header.Get(HeaderSignature) != Sign("0123456789abcdef", ts, body) {
+				t.Errorf("Signature does not match payload")
+			}
+			if r.Header.Get(HeaderEvent) != model.TopicLoginFailed || r.Header.Get(HeaderDelivery) != strconv.Itoa(id) {
+				t.Errorf("Event headers are wrong, want event %d: %v", id, r.Header)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %d was not delivered", id)
+		}
+	}
+
+	// Delivery failing all attempts ends up as dead letter
+	dispatch(model.Event{ID: 10, Type: model.TopicUserDeleted, Acct: "jacky_yang"})
+	waitFor(t, "dead letter", func() bool {
+		deadLetters, _ := repo.FindDeadLetters()
+		return len(deadLetters) == 1 && repo.pending() == 0
+	})
+	deadLetters, _ := repo.FindDeadLetters()
+	if deadLetters[0].WebhookID != 2 || deadLetters[0].EventID != 10 || deadLetters[0].Attempts != 2 {
+		t.Errorf("Dead letter is wrong: %+v", deadLetters[0])
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	d := NewDispatcher(&memRepo{}, 100, time.Second, time.Second)
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second,
+		12: 2048 * time.Second, 13: maxBackoff, 35: maxBackoff, 99: maxBackoff} {
+		if wait := d.retryDelay(attempts); wait != want {
+			t.Errorf("Delay after %d attempts is %s, want %s", attempts, wait, want)
+		}
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	repo := &memRepo{attempting: map[uint64]bool{},
+		hooks: []model.Webhook{{ID: 1, URL: "http://127.0.0.1:1/unreachable", Secret: "0123456789abcdef"}},
+		deadLetters: []model.WebhookDeadLetter{
+			{ID: 1, WebhookID: 1, EventID: 7, Payload: `{"id":7,"type":"login.failed"}`, Attempts: 5},
+			{ID: 2, WebhookID: 1, EventID: 8, Payload: `not json`, Attempts: 5},
+		}}
+	d := NewDispatcher(repo, 2, time.Hour, time.Second)
+
+	// Dead letter becomes delivery with fresh attempts
+	if err := d.Redeliver(1); err != nil {
+		t.Fatalf("Redeliver failed: %s", err)
+	}
+	if len(repo.deliveries) != 1 || repo.deliveries[0].Topic != model.TopicLoginFailed ||
+		repo.deliveries[0].Attempts != 0 || len(repo.deadLetters) != 1 {
+		t.Errorf("Dead letter was not queued: %+v", repo.deliveries)
+	}
+
+	// Undecodable or unknown dead letters are reported and kept
+	if err := d.Redeliver(2); err == nil || len(repo.deadLetters) != 1 {
+		t.Errorf("Undecodable dead letter was redelivered")
+	}
+	if err := d.Redeliver(1); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Redelivering unknown dead letter gave %v", err)
+	}
+}
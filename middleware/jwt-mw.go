@@ -3,6 +3,7 @@ package middleware
 import (
 	"github.com/golang-jwt/jwt"
 	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/problem"
 	"net/http"
 	"os"
 	"strings"
@@ -15,13 +16,14 @@ type JWTToken struct {
 }
 
 // GenerateJWT creates and signs new token
-func GenerateJWT(acct, fullname string) (JWTToken, error) {
+func GenerateJWT(acct, fullname, role string) (JWTToken, error) {
 	signingKeyBytes, _ := os.ReadFile(config.Cfg.Web.JWTPrivKey)
 	signingKey, _ := jwt.ParseRSAPrivateKeyFromPEM(signingKeyBytes)
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
 		"exp":  time.Now().Add(time.Hour * 1).Unix(),
 		"acct": acct,
 		"name": fullname,
+		"role": role,
 	})
 	signedToken, err := token.SignedString(signingKey)
 	return JWTToken{signedToken}, err
@@ -40,12 +42,22 @@ func VerifyJWTToken(signedToken string) (jwt.Claims, error) {
 	return token.Claims, err
 }
 
+// ClearIdentity removes acct and role headers sent by the client, only JWTHandler sets them
+// from a verified token
+func ClearIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("acct")
+		r.Header.Del("role")
+		next.ServeHTTP(w, r)
+	})
+}
+
 // JWTHandler protects routes with JWT token
 func JWTHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenString := r.Header.Get("Authorization")
 		if len(tokenString) == 0 {
-			http.Error(w, "Authorization header missing", http.StatusUnauthorized)
+			problem.Error(w, r, http.StatusUnauthorized, "Authorization header missing")
 			return
 		}
 
@@ -53,13 +65,26 @@ func JWTHandler(next http.Handler) http.Handler {
 		tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
 		claims, err := VerifyJWTToken(tokenString)
 		if err != nil {
-			http.Error(w, "Error verifying JWT token: "+err.Error(), http.StatusUnauthorized)
+			problem.Error(w, r, http.StatusUnauthorized, "Error verifying JWT token: "+err.Error())
 			return
 		}
 
 		// Extract account info from the claims
 		acct := claims.(jwt.MapClaims)["acct"].(string)
+		role, _ := claims.(jwt.MapClaims)["role"].(string)
 		r.Header.Set("acct", acct)
+		r.Header.Set("role", role)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminHandler lets only users with admin role through, it must be wrapped by JWTHandler
+func AdminHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("role") != "admin" {
+			problem.Error(w, r, http.StatusForbidden, "Admin role required")
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
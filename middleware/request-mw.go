@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"net/http"
+)
+
+// maxRequestIDLength limits request ID taken over from the client
+const maxRequestIDLength = 128
+
+// RequestID takes over X-Request-ID header of the client or generates one, it is returned
+// in response header and problem responses, so client reports can be matched with logs
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(problem.HeaderRequestID)
+		if !validRequestID(id) {
+			id = problem.NewID()
+		}
+
+		r.Header.Set(problem.HeaderRequestID, id)
+		w.Header().Set(problem.HeaderRequestID, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID accepts IDs of printable ASCII characters of reasonable length
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"github.com/golang-jwt/jwt"
+	"github.com/romanzac/gorilla-feast/infra/config"
+	"github.com/romanzac/gorilla-feast/infra/problem"
+	"net/http"
+	"strings"
+)
+
+// WSTokenProtocol prefixes the token when it is sent as websocket subprotocol "bearer.<token>".
+// Browsers cannot set headers on websocket connections, so they use this form instead.
+const WSTokenProtocol = "bearer."
+
+// TokenSubprotocol returns offered subprotocol which carries the token, if any.
+// Server should confirm it in the handshake, otherwise browsers drop the connection.
+func TokenSubprotocol(r *http.Request) string {
+	for _, p := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, WSTokenProtocol) {
+			return p
+		}
+	}
+	return ""
+}
+
+// wsToken finds token in Authorization header, token query parameter or bearer subprotocol
+func wsToken(r *http.Request) string {
+	if tokenString := r.Header.Get("Authorization"); tokenString != "" {
+		return strings.Replace(tokenString, "Bearer ", "", 1)
+	}
+	if tokenString := r.URL.Query().Get("token"); tokenString != "" {
+		return tokenString
+	}
+	return strings.TrimPrefix(TokenSubprotocol(r), WSTokenProtocol)
+}
+
+// WSJWTHandler protects websocket and event stream routes with JWT token and roles allowed to subscribe
+func WSJWTHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := wsToken(r)
+		if len(tokenString) == 0 {
+			problem.Error(w, r, http.StatusUnauthorized,
+				"Token missing in Authorization header, token parameter or subprotocol")
+			return
+		}
+
+		claims, err := VerifyJWTToken(tokenString)
+		if err != nil {
+			problem.Error(w, r, http.StatusUnauthorized, "Error verifying JWT token: "+err.Error())
+			return
+		}
+
+		// Extract account info from the claims and check the role
+		acct, _ := claims.(jwt.MapClaims)["acct"].(string)
+		role, _ := claims.(jwt.MapClaims)["role"].(string)
+		if !roleAllowed(role, config.Cfg.Web.WSAllowedRoles) {
+			problem.Error(w, r, http.StatusForbidden, "Role is not allowed to subscribe")
+			return
+		}
+
+		r.Header.Set("acct", acct)
+		r.Header.Set("role", role)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// roleAllowed checks role against the list of allowed roles
+func roleAllowed(role string, allowed []string) bool {
+	for _, a := range allowed {
+		if role != "" && role == a {
+			return true
+		}
+	}
+	return false
+}
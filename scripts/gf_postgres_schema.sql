@@ -3,9 +3,109 @@ CREATE TABLE users
     acct       VARCHAR(50) UNIQUE NOT NULL,
     pwd        VARCHAR(100),
     fullname   VARCHAR(100),
+    role       VARCHAR(20)        NOT NULL
+        DEFAULT 'user',
     created_at TIMESTAMPTZ        NOT NULL
         DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMPTZ        NOT NULL
+        DEFAULT CURRENT_TIMESTAMP,
+    version    BIGINT             NOT NULL
+        DEFAULT 1
+);
+
+-- Keyset pagination of user lists, the fullname index serves the default SortCollation
+CREATE INDEX users_fullname_sort ON users ((COALESCE(fullname, '') COLLATE "und-x-icu"), acct);
+CREATE INDEX users_created_at_sort ON users (created_at, acct);
+CREATE INDEX users_updated_at_sort ON users (updated_at, acct);
+
+-- Fuzzy search ignoring case and accents, unaccent itself is not immutable and cannot be indexed
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+CREATE FUNCTION immutable_unaccent(TEXT) RETURNS TEXT AS
+$$
+SELECT public.unaccent('public.unaccent', $1)
+$$ LANGUAGE SQL IMMUTABLE PARALLEL SAFE STRICT;
+
+CREATE INDEX users_search ON users
+    USING GIN ((immutable_unaccent(lower(acct || ' ' || COALESCE(fullname, '')))) gin_trgm_ops);
+
+
+CREATE TABLE events
+(
+    id     BIGINT PRIMARY KEY,
+    type   VARCHAR(50) NOT NULL,
+    acct   VARCHAR(50) NOT NULL,
+    time   TIMESTAMPTZ NOT NULL,
+    detail TEXT
+);
+
+CREATE SEQUENCE event_ids;
+
+CREATE TABLE outbox_events
+(
+    id     BIGSERIAL PRIMARY KEY,
+    type   VARCHAR(50) NOT NULL,
+    acct   VARCHAR(50) NOT NULL,
+    time   TIMESTAMPTZ NOT NULL,
+    detail TEXT
+);
+
+CREATE TABLE webhooks
+(
+    id          BIGSERIAL PRIMARY KEY,
+    url         TEXT         NOT NULL,
+    event_types TEXT         NOT NULL
+        DEFAULT '',
+    secret      VARCHAR(100) NOT NULL,
+    created_at  TIMESTAMPTZ  NOT NULL
+        DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Events waiting for delivery, every webhook gets them in ID order
+CREATE TABLE webhook_deliveries
+(
+    id              BIGSERIAL PRIMARY KEY,
+    webhook_id      BIGINT      NOT NULL
+        REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id        BIGINT      NOT NULL,
+    topic           VARCHAR(50) NOT NULL,
+    payload         TEXT        NOT NULL,
+    attempts        INT         NOT NULL
+        DEFAULT 0,
+    last_error      TEXT        NOT NULL
+        DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL
+        DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX webhook_deliveries_order ON webhook_deliveries (webhook_id, id);
+
+CREATE TABLE webhook_dead_letters
+(
+    id         BIGSERIAL PRIMARY KEY,
+    webhook_id BIGINT      NOT NULL
+        REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id   BIGINT      NOT NULL,
+    payload    TEXT        NOT NULL,
+    attempts   INT         NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL
         DEFAULT CURRENT_TIMESTAMP
 );
 
+-- First responses to POST requests with Idempotency-Key, replayed for retries until they expire
+CREATE TABLE idempotency_keys
+(
+    id           CHAR(64) PRIMARY KEY,
+    fingerprint  CHAR(64)    NOT NULL,
+    status       INT         NOT NULL
+        DEFAULT 0,
+    header       TEXT        NOT NULL
+        DEFAULT '',
+    body         BYTEA,
+    expires_at   TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at);